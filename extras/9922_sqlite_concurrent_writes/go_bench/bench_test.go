@@ -3,15 +3,20 @@
 package sqlite_bench
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"math"
+	"os"
 	"path"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 func BenchmarkWriteDifferentSizes(b *testing.B) {
@@ -139,14 +144,17 @@ func BenchmarkReadAndWriteConcurrentWithoutMutex(b *testing.B) {
 	}
 }
 
-func noErr(b *testing.B, err error) {
+func noErr(b testing.TB, err error) {
 	if err != nil {
 		b.Fatal(err)
 	}
 }
 
-func makeDB(b *testing.B, options string) *sql.DB {
-	dbPath := path.Join(b.TempDir(), "benchmark.db")
+func makeDB(b testing.TB, options string) *sql.DB {
+	return makeDBAt(b, path.Join(b.TempDir(), "benchmark.db"), options)
+}
+
+func makeDBAt(b testing.TB, dbPath string, options string) *sql.DB {
 	db, err := sql.Open("sqlite3", dbPath+options)
 	if err != nil {
 		b.Fatal(err)
@@ -157,6 +165,49 @@ func makeDB(b *testing.B, options string) *sql.DB {
 	return db
 }
 
+// makeDBWithPragmas is like makeDB but executes pragmas on every connection
+// in the pool, not just on the one that happens to run db.Exec.
+func makeDBWithPragmas(b testing.TB, options string, pragmas ...string) *sql.DB {
+	db := openWithPragmas(path.Join(b.TempDir(), "benchmark.db")+options, pragmas...)
+	if err := setupDB(db); err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+func openWithPragmas(dsn string, pragmas ...string) *sql.DB {
+	return openWithHook(dsn, func(conn *sqlite3.SQLiteConn) error {
+		for _, pragma := range pragmas {
+			if _, err := conn.Exec("pragma "+pragma, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// openWithHook opens dsn with a go-sqlite3 driver that runs hook on every new
+// connection. Unlike sql.Register, it doesn't need a unique driver name.
+func openWithHook(dsn string, hook func(*sqlite3.SQLiteConn) error) *sql.DB {
+	return sql.OpenDB(hookConnector{
+		dsn:    dsn,
+		driver: &sqlite3.SQLiteDriver{ConnectHook: hook},
+	})
+}
+
+type hookConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c hookConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c hookConnector) Driver() driver.Driver {
+	return c.driver
+}
+
 func setupDB(db *sql.DB) error {
 	_, err := db.Exec(`
 			create table posts (
@@ -180,7 +231,54 @@ func writeBlogPostMutexed(db *sql.DB, content string) error {
 	return err
 }
 
+func readBlogPostByID(db *sql.DB, id int64) (string, error) {
+	var content string
+	err := db.QueryRow(`select content from posts where id = ?`, id).Scan(&content)
+	return content, err
+}
+
+// readBlogPost uses Exec for a select, which steps the statement once and
+// discards the row instead of reading it. It's kept as is so the results
+// stay comparable with the ones in the README. Use Query or QueryRow to read
+// rows, as readBlogPostByID does.
 func readBlogPost(db *sql.DB) error {
 	_, err := db.Exec(`select * from posts limit 1`)
 	return err
 }
+
+// requireSQLiteVersion skips b if SQLite is older than version, given as
+// in sqlite3_libversion_number, e.g. 3033000 for 3.33.0.
+func requireSQLiteVersion(b testing.TB, version int) {
+	if libVersion, libVersionNumber, _ := sqlite3.Version(); libVersionNumber < version {
+		b.Skipf("needs SQLite %d, got %s", version, libVersion)
+	}
+}
+
+func isBusy(err error) bool {
+	code, _, _ := describeError(err)
+	return code == int(sqlite3.ErrBusy)
+}
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+type latencies []time.Duration
+
+func (l latencies) percentile(p float64) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(l)
+	slices.Sort(sorted)
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func reportLatencies(b *testing.B, l latencies, prefix string) {
+	b.ReportMetric(float64(l.percentile(0.5).Nanoseconds()), prefix+"p50-ns")
+	b.ReportMetric(float64(l.percentile(0.99).Nanoseconds()), prefix+"p99-ns")
+}
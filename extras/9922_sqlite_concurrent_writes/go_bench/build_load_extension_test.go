@@ -0,0 +1,5 @@
+//go:build !sqlite_omit_load_extension
+
+package sqlite_bench
+
+const loadExtensionBuild = "default"
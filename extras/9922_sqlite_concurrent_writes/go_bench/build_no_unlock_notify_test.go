@@ -0,0 +1,5 @@
+//go:build !sqlite_unlock_notify
+
+package sqlite_bench
+
+const unlockNotifyBuild = false
@@ -0,0 +1,102 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// BenchmarkBuildConfig runs the write and read workloads on whatever
+// go-sqlite3 build configuration the test binary was built with, so its
+// results can be compared across builds:
+//
+//	go test -bench BenchmarkBuildConfig -cpu=1
+//	go test -tags sqlite_omit_load_extension -bench BenchmarkBuildConfig -cpu=1
+//
+// binary-bytes is the size of the test binary.
+func BenchmarkBuildConfig(b *testing.B) {
+	exe, err := os.Executable()
+	noErr(b, err)
+	binarySize := fileSize(exe)
+	for _, workload := range []string{"write", "read"} {
+		b.Run(fmt.Sprintf("build=%s&workload=%s", loadExtensionBuild, workload), func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			content := strings.Repeat("A", 1000)
+			noErr(b, insertRowsLoop(db, content, 1000))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var err error
+				if workload == "write" {
+					err = writeBlogPost(db, content)
+				} else {
+					_, err = readBlogPostByID(db, int64(i%1000+1))
+				}
+				noErr(b, err)
+			}
+			b.ReportMetric(float64(binarySize), "binary-bytes")
+		})
+	}
+}
+
+// isLocked reports whether err is SQLITE_LOCKED, which is what a shared-cache
+// connection gets when another connection holds a table lock.
+func isLocked(err error) bool {
+	code, _, _ := describeError(err)
+	return code == int(sqlite3.ErrLocked)
+}
+
+// BenchmarkSharedCacheUnlockNotify runs concurrent write transactions on
+// shared-cache connections. busy_timeout doesn't apply to shared-cache table
+// locks, so without unlock-notify a writer gets SQLITE_LOCKED right away and
+// restarts its transaction in a polling loop. With the sqlite_unlock_notify
+// build tag, go-sqlite3 blocks until the lock is released instead. Compare
+// the two builds:
+//
+//	go test -bench BenchmarkSharedCacheUnlockNotify -cpu=1
+//	go test -tags sqlite_unlock_notify -bench BenchmarkSharedCacheUnlockNotify -cpu=1
+//
+// cpu-s/op is only reported where the process CPU time can be read.
+// Should be used with -cpu=1.
+func BenchmarkSharedCacheUnlockNotify(b *testing.B) {
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("unlock_notify=%t&concurrency=%d", unlockNotifyBuild, concurrency), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			db := makeDBAt(b, "file:"+dbPath, "?cache=shared&_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			content := strings.Repeat("A", 1000)
+			var polls atomic.Int64
+			cpuStart, cpuErr := cpuTime()
+			b.SetParallelism(concurrency)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					for {
+						err := runTx(db, func(tx *sql.Tx) error {
+							_, err := tx.Exec(`insert into posts (content) values (?)`, content)
+							return err
+						})
+						if !isLocked(err) {
+							noErr(b, err)
+							break
+						}
+						polls.Add(1)
+						runtime.Gosched()
+					}
+				}
+			})
+			b.StopTimer()
+			if cpuErr == nil {
+				cpuEnd, err := cpuTime()
+				noErr(b, err)
+				b.ReportMetric((cpuEnd-cpuStart).Seconds()/float64(b.N), "cpu-s/op")
+			}
+			b.ReportMetric(float64(polls.Load())/float64(b.N), "polls/op")
+		})
+	}
+}
@@ -0,0 +1,553 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seriesCTE defines series(value) as the integers from 1 to ?1.
+const seriesCTE = `
+	with recursive series(value) as (
+		select 1 union all select value + 1 from series where value < ?1
+	)`
+
+// insertSeries runs insert, which selects from series, with series holding
+// the integers from 1 to n, to insert rows without a Go-side loop. The
+// placeholders in insert are bound to args.
+func insertSeries(db *sql.DB, insert string, n int, args ...any) error {
+	_, err := db.Exec(seriesCTE+insert, append([]any{n}, args...)...)
+	return err
+}
+
+// seriesInserts insert ?1 rows with content ?2 into posts without a Go-side
+// loop. generate_series is only available if SQLite is built with the
+// series extension, which go-sqlite3 doesn't do by default.
+var seriesInserts = map[string]string{
+	"generate_series": `
+		insert into posts (content)
+		select ?2 from generate_series(1, ?1)`,
+	"recursive-cte": seriesCTE + `
+		insert into posts (content)
+		select ?2 from series`,
+}
+
+func hasGenerateSeries(db *sql.DB) bool {
+	var value int
+	return db.QueryRow(`select value from generate_series(1, 1)`).Scan(&value) == nil
+}
+
+func insertRowsLoop(db *sql.DB, content string, n int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`insert into posts (content) values (?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i := 0; i < n; i++ {
+		if _, err := stmt.Exec(content); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// BenchmarkInsertGeneratedSeries compares inserting n rows generated in SQL
+// with inserting them one by one from Go. The Go loop runs in a single
+// transaction, so the difference is the per-row round trip only.
+func BenchmarkInsertGeneratedSeries(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		for _, method := range []string{"go-loop", "recursive-cte", "generate_series"} {
+			b.Run(fmt.Sprintf("method=%s&rows=%d", method, n), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				if method == "generate_series" && !hasGenerateSeries(db) {
+					b.Skip("generate_series is not compiled in")
+				}
+				content := strings.Repeat("A", 100)
+				b.ResetTimer()
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					var err error
+					if method == "go-loop" {
+						err = insertRowsLoop(db, content, n)
+					} else {
+						_, err = db.Exec(seriesInserts[method], n, content)
+					}
+					noErr(b, err)
+				}
+				b.ReportMetric(float64(b.N*n)/time.Since(start).Seconds(), "rows/s")
+			})
+		}
+	}
+}
+
+// BenchmarkInsertGeneratedSeriesReturning compares SQL-side inserts of n rows
+// with and without a RETURNING clause that streams every new id back to Go.
+func BenchmarkInsertGeneratedSeriesReturning(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		for _, method := range []string{"recursive-cte", "generate_series"} {
+			for _, returning := range []bool{false, true} {
+				b.Run(fmt.Sprintf("method=%s&rows=%d&returning=%t", method, n, returning), func(b *testing.B) {
+					db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+					if method == "generate_series" && !hasGenerateSeries(db) {
+						b.Skip("generate_series is not compiled in")
+					}
+					content := strings.Repeat("A", 100)
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						var err error
+						if returning {
+							err = insertSeriesReturning(db, seriesInserts[method], content, n)
+						} else {
+							_, err = db.Exec(seriesInserts[method], n, content)
+						}
+						noErr(b, err)
+					}
+					b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/row")
+				})
+			}
+		}
+	}
+}
+
+func insertSeriesReturning(db *sql.DB, query string, content string, n int) error {
+	rows, err := db.Query(query+` returning id`, n, content)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	ids := make([]int64, 0, n)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(ids) != n {
+		return fmt.Errorf("got %d ids, want %d", len(ids), n)
+	}
+	return nil
+}
+
+type postUpdate struct {
+	id      int64
+	content string
+}
+
+// bulkUpdate loads updates into a temp table and applies them with a single
+// UPDATE ... FROM join (SQLite 3.33+). Temp tables are per connection, so
+// everything runs in one transaction. Later updates of the same id win.
+func bulkUpdate(db *sql.DB, updates []postUpdate) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		create temp table if not exists post_updates (
+			id integer primary key,
+			content text not null
+		);
+		delete from temp.post_updates`)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`insert or replace into temp.post_updates (id, content) values (?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, u := range updates {
+		if _, err := stmt.Exec(u.id, u.content); err != nil {
+			return err
+		}
+	}
+	// Without statistics the planner assumes both tables are equally big and
+	// scans posts, looking up each row in post_updates.
+	if _, err := tx.Exec(`analyze temp.post_updates`); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		update posts set content = u.content
+		from temp.post_updates u
+		where posts.id = u.id`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateRowsLoop(db *sql.DB, updates []postUpdate, inTx bool) error {
+	if !inTx {
+		for _, u := range updates {
+			if _, err := db.Exec(`update posts set content = ? where id = ?`, u.content, u.id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`update posts set content = ? where id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, u := range updates {
+		if _, err := stmt.Exec(u.content, u.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// BenchmarkBulkUpdate compares updating n random rows one statement at a
+// time, with and without a wrapping transaction, against bulkUpdate.
+func BenchmarkBulkUpdate(b *testing.B) {
+	requireSQLiteVersion(b, 3033000)
+	const rows = 100000
+	for _, n := range []int{100, 1000, 10000} {
+		for _, method := range []string{"per-row", "per-row-tx", "update-from"} {
+			b.Run(fmt.Sprintf("method=%s&rows=%d", method, n), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				_, err := db.Exec(seriesInserts["recursive-cte"], rows, strings.Repeat("A", 100))
+				noErr(b, err)
+				updates := make([]postUpdate, n)
+				for i := range updates {
+					updates[i] = postUpdate{id: rand.Int64N(rows) + 1, content: strings.Repeat("B", 100)}
+				}
+				b.ResetTimer()
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					var err error
+					switch method {
+					case "per-row":
+						err = updateRowsLoop(db, updates, false)
+					case "per-row-tx":
+						err = updateRowsLoop(db, updates, true)
+					default:
+						err = bulkUpdate(db, updates)
+					}
+					noErr(b, err)
+				}
+				b.ReportMetric(float64(b.N*n)/time.Since(start).Seconds(), "rows/s")
+			})
+		}
+	}
+}
+
+// deleteBatched deletes the posts with id <= maxID in transactions of up to
+// batch rows, or in a single statement if batch is 0, and returns the
+// longest statement, which is how long the write lock was held at most.
+// It sleeps for pause between batches. Without a pause, other writers
+// rarely get the lock between batches, and SQLite's busy handler backs off
+// to sleeping up to 100ms between their attempts.
+func deleteBatched(db *sql.DB, maxID int64, batch int, pause time.Duration) (time.Duration, error) {
+	if batch == 0 {
+		t := time.Now()
+		_, err := db.Exec(`delete from posts where id <= ?`, maxID)
+		return time.Since(t), err
+	}
+	var longest time.Duration
+	for {
+		t := time.Now()
+		res, err := db.Exec(`
+			delete from posts where id in (
+				select id from posts where id <= ? limit ?
+			)`, maxID, batch)
+		longest = max(longest, time.Since(t))
+		if err != nil {
+			return longest, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil || n < int64(batch) {
+			return longest, err
+		}
+		time.Sleep(pause)
+	}
+}
+
+// BenchmarkBatchedDelete deletes the oldest 100000 of 200000 posts per op in
+// one statement or in batches while another goroutine keeps writing.
+// max-lock-hold-ns is the longest delete statement, the writer's latency
+// shows how long it was blocked.
+func BenchmarkBatchedDelete(b *testing.B) {
+	const rows, deleted = 200000, 100000
+	for _, batch := range []int{0, 10000, 1000, 100} {
+		for _, pause := range []time.Duration{0, time.Millisecond} {
+			if batch == 0 && pause > 0 {
+				continue
+			}
+			name := fmt.Sprint(batch)
+			if batch == 0 {
+				name = "single"
+			}
+			b.Run(fmt.Sprintf("batch=%s&pause=%s", name, pause), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				content := strings.Repeat("A", 100)
+				var longest time.Duration
+				var writeLats latencies
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					_, err := db.Exec(`delete from posts`)
+					noErr(b, err)
+					_, err = db.Exec(seriesInserts["recursive-cte"], rows, content)
+					noErr(b, err)
+					var minID int64
+					noErr(b, db.QueryRow(`select min(id) from posts`).Scan(&minID))
+					done := make(chan struct{})
+					var wg sync.WaitGroup
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for {
+							select {
+							case <-done:
+								return
+							default:
+							}
+							t := time.Now()
+							err := writeBlogPost(db, content)
+							writeLats = append(writeLats, time.Since(t))
+							if err != nil {
+								b.Error(err)
+								return
+							}
+							time.Sleep(time.Millisecond)
+						}
+					}()
+					b.StartTimer()
+
+					d, err := deleteBatched(db, minID+deleted-1, batch, pause)
+					noErr(b, err)
+					longest = max(longest, d)
+
+					b.StopTimer()
+					close(done)
+					wg.Wait()
+					b.StartTimer()
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(longest.Nanoseconds()), "max-lock-hold-ns")
+				b.ReportMetric(float64(writeLats.percentile(1).Nanoseconds()), "write-max-ns")
+				reportLatencies(b, writeLats, "write-")
+			})
+		}
+	}
+}
+
+// indexPages returns the number of pages of index name, as the number of
+// pages dropping it would free. The drop is rolled back.
+func indexPages(db *sql.DB, name string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var before, after int
+	if err := tx.QueryRow(`pragma freelist_count`).Scan(&before); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`drop index %s`, name)); err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRow(`pragma freelist_count`).Scan(&after); err != nil {
+		return 0, err
+	}
+	return after - before, nil
+}
+
+// loadItems inserts n items with random hex keys in transactions of 10000.
+func loadItems(db *sql.DB, n int) error {
+	for i := 0; i < n; i += 10000 {
+		err := insertSeries(db, `
+			insert into items (key) select hex(randomblob(8)) from series`, min(10000, n-i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BenchmarkReindexAfterLoad loads 100000 items with random keys and then
+// scans 1000 keys of the key index from a random start. With
+// index=during-load the index is maintained while loading, so its pages are
+// split as keys arrive out of order. index=after-load creates it after the
+// load, and index=reindex builds it during the load and rebuilds it with
+// REINDEX afterwards. Both of those sort the keys and fill the index pages
+// in order.
+func BenchmarkReindexAfterLoad(b *testing.B) {
+	const rows = 100000
+	for _, strategy := range []string{"during-load", "after-load", "reindex"} {
+		b.Run(fmt.Sprintf("index=%s", strategy), func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			defer db.Close()
+			_, err := db.Exec(`create table items (id integer primary key, key text not null)`)
+			noErr(b, err)
+			if strategy != "after-load" {
+				_, err := db.Exec(`create index items_key on items (key)`)
+				noErr(b, err)
+			}
+			noErr(b, loadItems(db, rows))
+			switch strategy {
+			case "after-load":
+				_, err = db.Exec(`create index items_key on items (key)`)
+			case "reindex":
+				_, err = db.Exec(`reindex items_key`)
+			}
+			noErr(b, err)
+			pages, err := indexPages(db, "items_key")
+			noErr(b, err)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var count int
+				err := db.QueryRow(`
+					select count(*) from (
+						select key from items where key >= ? order by key limit 1000
+					)`, fmt.Sprintf("%016X", rand.Uint64())).Scan(&count)
+				noErr(b, err)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(pages), "index-pages")
+		})
+	}
+}
+
+// BenchmarkIndexBeforeLoad loads 1M items with random keys into a table
+// whose key index exists during the load, or is created after it. One op is
+// the whole load including the index build. Should be used with
+// -benchtime=1x.
+func BenchmarkIndexBeforeLoad(b *testing.B) {
+	const rows = 1000000
+	for _, index := range []string{"before", "after"} {
+		b.Run(fmt.Sprintf("index=%s", index), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				_, err := db.Exec(`create table items (id integer primary key, key text not null)`)
+				noErr(b, err)
+				b.StartTimer()
+				if index == "before" {
+					_, err := db.Exec(`create index items_key on items (key)`)
+					noErr(b, err)
+				}
+				noErr(b, loadItems(db, rows))
+				if index == "after" {
+					_, err := db.Exec(`create index items_key on items (key)`)
+					noErr(b, err)
+				}
+				b.StopTimer()
+				noErr(b, db.Close())
+			}
+			b.ReportMetric(float64(rows)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+// upsertPosts upserts posts by id and returns the ids of the inserted or
+// updated rows. With method=multi-row it sends all of them in one
+// INSERT ... VALUES statement with a RETURNING clause, with
+// method=multi-row-exec the same statement without RETURNING, which returns
+// no ids, and with method=per-row one statement per post, all in one
+// transaction.
+func upsertPosts(db *sql.DB, method string, updates []postUpdate) ([]int64, error) {
+	const upsert = ` on conflict (id) do update set content = excluded.content`
+	if method == "per-row" {
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		stmt, err := tx.Prepare(`insert into posts (id, content) values (?, ?)` + upsert + ` returning id`)
+		if err != nil {
+			return nil, err
+		}
+		defer stmt.Close()
+		ids := make([]int64, len(updates))
+		for i, u := range updates {
+			if err := stmt.QueryRow(u.id, u.content).Scan(&ids[i]); err != nil {
+				return nil, err
+			}
+		}
+		return ids, tx.Commit()
+	}
+
+	query := `insert into posts (id, content) values ` + strings.TrimSuffix(strings.Repeat("(?, ?),", len(updates)), ",") + upsert
+	args := make([]any, 0, 2*len(updates))
+	for _, u := range updates {
+		args = append(args, u.id, u.content)
+	}
+	if method == "multi-row-exec" {
+		_, err := db.Exec(query, args...)
+		return nil, err
+	}
+	rows, err := db.Query(query+` returning id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int64, 0, len(updates))
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// BenchmarkUpsertReturning upserts batches of posts where half the ids
+// already exist and half are new. Comparing multi-row with multi-row-exec
+// gives the cost of returning and scanning the ids. RETURNING needs SQLite
+// 3.35.
+func BenchmarkUpsertReturning(b *testing.B) {
+	const existing = 100000
+	for _, batch := range []int{10, 100, 1000} {
+		for _, method := range []string{"per-row", "multi-row", "multi-row-exec"} {
+			b.Run(fmt.Sprintf("batch=%d&method=%s", batch, method), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				defer db.Close()
+				requireSQLiteVersion(b, 3035000)
+				content := strings.Repeat("A", 100)
+				noErr(b, insertRowsLoop(db, content, existing))
+				next := int64(existing)
+				updates := make([]postUpdate, batch)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for j := range updates {
+						if j%2 == 0 {
+							updates[j] = postUpdate{rand.Int64N(existing) + 1, content}
+						} else {
+							next++
+							updates[j] = postUpdate{next, content}
+						}
+					}
+					ids, err := upsertPosts(db, method, updates)
+					noErr(b, err)
+					if method != "multi-row-exec" && len(ids) != batch {
+						b.Fatalf("got %d ids, want %d", len(ids), batch)
+					}
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(b.N*batch)/b.Elapsed().Seconds(), "rows/s")
+			})
+		}
+	}
+}
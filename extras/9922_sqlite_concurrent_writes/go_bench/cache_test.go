@@ -0,0 +1,165 @@
+package sqlite_bench
+
+import (
+	"container/list"
+	"database/sql"
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ReadThroughCache is an LRU cache of posts in front of readBlogPostByID.
+// Update writes through to SQLite and invalidates the cached post.
+// A Get that misses while an Update of the same post is running can still
+// cache the old content; that's fine for benchmarking but not in general.
+type ReadThroughCache struct {
+	db   *sql.DB
+	size int
+
+	mu      sync.Mutex
+	entries map[int64]*list.Element
+	lru     *list.List
+	hits    int
+	misses  int
+}
+
+type cacheEntry struct {
+	id      int64
+	content string
+}
+
+func NewReadThroughCache(db *sql.DB, size int) *ReadThroughCache {
+	return &ReadThroughCache{
+		db:      db,
+		size:    size,
+		entries: make(map[int64]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+func (c *ReadThroughCache) Get(id int64) (string, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[id]; ok {
+		c.lru.MoveToFront(e)
+		c.hits++
+		c.mu.Unlock()
+		return e.Value.(*cacheEntry).content, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	content, err := readBlogPostByID(c.db, id)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[id]; !ok {
+		c.entries[id] = c.lru.PushFront(&cacheEntry{id: id, content: content})
+		if c.lru.Len() > c.size {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cacheEntry).id)
+		}
+	}
+	return content, nil
+}
+
+func (c *ReadThroughCache) Update(id int64, content string) error {
+	if _, err := c.db.Exec(`update posts set content = ? where id = ?`, content, id); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[id]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, id)
+	}
+	return nil
+}
+
+// HitRate returns the fraction of Gets served from the cache.
+func (c *ReadThroughCache) HitRate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hits+c.misses == 0 {
+		return 0
+	}
+	return float64(c.hits) / float64(c.hits+c.misses)
+}
+
+// BenchmarkReadThroughCache reads posts through a ReadThroughCache at a
+// target hit rate. Hits go to a small hot set that always stays cached.
+// Misses walk through the rest of the table, which is much larger than the
+// cache, so they are evicted before they are read again.
+func BenchmarkReadThroughCache(b *testing.B) {
+	const rows, hot, cacheSize = 20000, 100, 1000
+	for _, hitRate := range []float64{0, 0.5, 0.9, 0.99} {
+		name := fmt.Sprintf("hit_rate=%g", hitRate)
+		if hitRate == 0 {
+			name = "no_cache"
+		}
+		b.Run(name, func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			noErr(b, insertRowsLoop(db, strings.Repeat("A", 1000), rows))
+			read := func(id int64) (string, error) { return readBlogPostByID(db, id) }
+			cache := NewReadThroughCache(db, cacheSize)
+			if hitRate > 0 {
+				read = cache.Get
+				for id := int64(1); id <= hot; id++ {
+					_, err := cache.Get(id)
+					noErr(b, err)
+				}
+			}
+			lats := make(latencies, 0, b.N)
+			cold := int64(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var id int64
+				if rand.Float64() < hitRate {
+					id = rand.Int64N(hot) + 1
+				} else {
+					id = hot + 1 + cold%(rows-hot)
+					cold++
+				}
+				t := time.Now()
+				_, err := read(id)
+				lats = append(lats, time.Since(t))
+				noErr(b, err)
+			}
+			b.StopTimer()
+			if hitRate > 0 {
+				b.ReportMetric(cache.HitRate(), "measured-hit-rate")
+			}
+			reportLatencies(b, lats, "read-")
+		})
+	}
+}
+
+func TestReadThroughCacheInvalidation(t *testing.T) {
+	db, err := sql.Open("sqlite3", path.Join(t.TempDir(), "test.db")+"?_journal=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := setupDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeBlogPost(db, "old"); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewReadThroughCache(db, 10)
+	if got, err := cache.Get(1); err != nil || got != "old" {
+		t.Fatalf("Get(1) = %q, %v, want %q", got, err, "old")
+	}
+	if err := cache.Update(1, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cache.Get(1); err != nil || got != "new" {
+		t.Fatalf("Get(1) after Update = %q, %v, want %q", got, err, "new")
+	}
+}
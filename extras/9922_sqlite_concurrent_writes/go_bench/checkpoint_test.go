@@ -0,0 +1,619 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// steadyWriteInterval paces writers to 5000 writes/s.
+const steadyWriteInterval = 200 * time.Microsecond
+
+// BenchmarkPassiveCheckpointUnderSteadyWrites writes at a steady rate while a
+// separate connection runs wal_checkpoint(PASSIVE) every interval.
+// The writer has auto-checkpointing disabled, so only the background
+// checkpoints keep the WAL bounded. interval=auto is the default
+// auto-checkpoint (every 1000 pages) for reference.
+func BenchmarkPassiveCheckpointUnderSteadyWrites(b *testing.B) {
+	for _, interval := range []time.Duration{0, time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond, time.Second} {
+		name := interval.String()
+		if interval == 0 {
+			name = "auto"
+		}
+		b.Run(fmt.Sprintf("interval=%s", name), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			db := makeDBAt(b, dbPath, options)
+			db.SetMaxOpenConns(1)
+			if interval > 0 {
+				_, err := db.Exec(`pragma wal_autocheckpoint=0`)
+				noErr(b, err)
+			}
+			ckptDB, err := sql.Open("sqlite3", dbPath+options)
+			noErr(b, err)
+			defer ckptDB.Close()
+
+			var walMax int64
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			if interval > 0 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ticker := time.NewTicker(interval)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-done:
+							return
+						case <-ticker.C:
+							walMax = max(walMax, fileSize(dbPath+"-wal"))
+							if _, err := ckptDB.Exec(`pragma wal_checkpoint(PASSIVE)`); err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					}
+				}()
+			}
+
+			content := strings.Repeat("A", 1000)
+			lats := make(latencies, 0, b.N)
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if d := time.Until(start.Add(time.Duration(i) * steadyWriteInterval)); d > 0 {
+					time.Sleep(d)
+				}
+				t := time.Now()
+				err := writeBlogPost(db, content)
+				lats = append(lats, time.Since(t))
+				noErr(b, err)
+			}
+			b.StopTimer()
+			close(done)
+			wg.Wait()
+
+			walFinal := fileSize(dbPath + "-wal")
+			b.ReportMetric(float64(max(walMax, walFinal)), "wal-max-bytes")
+			b.ReportMetric(float64(walFinal), "wal-final-bytes")
+			reportLatencies(b, lats, "write-")
+		})
+	}
+}
+
+// checkpointStats runs wal_checkpoint(mode) and returns its result row:
+// busy is 1 if the checkpoint couldn't finish because of readers or writers,
+// log is the number of frames in the WAL and ckpt is the number of frames
+// checkpointed into the database. A successful TRUNCATE checkpoint reports
+// 0 and 0 since it empties the WAL.
+func checkpointStats(db *sql.DB, mode string) (busy, log, ckpt int, err error) {
+	err = db.QueryRow(fmt.Sprintf(`pragma wal_checkpoint(%s)`, mode)).Scan(&busy, &log, &ckpt)
+	return busy, log, ckpt, err
+}
+
+// checkpointer runs background checkpoints for BenchmarkAdaptiveCheckpoint.
+// Every interval, both modes run a non-blocking PASSIVE checkpoint, which
+// reports how many frames are in the WAL, and then a TRUNCATE checkpoint.
+// The adaptive mode only escalates to TRUNCATE when the PASSIVE one reports
+// more than threshold frames, which happens when readers keep the WAL from
+// being reset. maxLog is the most frames a PASSIVE checkpoint reported.
+type checkpointer struct {
+	db        *sql.DB
+	adaptive  bool
+	interval  time.Duration
+	threshold int
+
+	truncates     int
+	busyTruncates int
+	maxLog        int
+}
+
+func (c *checkpointer) run(done <-chan struct{}) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+		_, log, _, err := checkpointStats(c.db, "PASSIVE")
+		if err != nil {
+			return err
+		}
+		c.maxLog = max(c.maxLog, log)
+		if c.adaptive && log <= c.threshold {
+			continue
+		}
+		busy, _, _, err := checkpointStats(c.db, "TRUNCATE")
+		if err != nil {
+			return err
+		}
+		c.truncates++
+		c.busyTruncates += busy
+	}
+}
+
+// BenchmarkAdaptiveCheckpoint compares TRUNCATE checkpoints on every tick of
+// a fixed interval with adaptive checkpointing driven by the wal_checkpoint
+// counters, which checks the WAL on the same tick.
+// A writer writes at a steady rate with auto-checkpointing disabled while a
+// reader keeps running short read transactions, which may make TRUNCATE
+// checkpoints return busy.
+func BenchmarkAdaptiveCheckpoint(b *testing.B) {
+	for _, mode := range []string{"fixed", "adaptive"} {
+		b.Run(fmt.Sprintf("mode=%s", mode), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			db := makeDBAt(b, dbPath, options)
+			db.SetMaxOpenConns(1)
+			_, err := db.Exec(`pragma wal_autocheckpoint=0`)
+			noErr(b, err)
+			readDB, err := sql.Open("sqlite3", dbPath+options)
+			noErr(b, err)
+			defer readDB.Close()
+			// A blocking checkpoint holds the write lock while it waits for
+			// readers, so give up quickly instead of stalling the writer.
+			ckptDB, err := sql.Open("sqlite3", dbPath+"?_journal=WAL&_timeout=50")
+			noErr(b, err)
+			defer ckptDB.Close()
+			noErr(b, writeBlogPost(db, "A"))
+
+			c := &checkpointer{db: ckptDB, adaptive: mode == "adaptive", interval: 10 * time.Millisecond, threshold: 1000}
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				if err := c.run(done); err != nil {
+					b.Error(err)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if err := readInTx(readDB, 5*time.Millisecond); err != nil {
+						b.Error(err)
+						return
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+			}()
+
+			content := strings.Repeat("A", 1000)
+			lats := make(latencies, 0, b.N)
+			var walMax int64
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if d := time.Until(start.Add(time.Duration(i) * steadyWriteInterval)); d > 0 {
+					time.Sleep(d)
+				}
+				t := time.Now()
+				err := writeBlogPost(db, content)
+				lats = append(lats, time.Since(t))
+				noErr(b, err)
+				if i%100 == 0 {
+					walMax = max(walMax, fileSize(dbPath+"-wal"))
+				}
+			}
+			b.StopTimer()
+			close(done)
+			wg.Wait()
+
+			b.ReportMetric(float64(walMax), "wal-max-bytes")
+			b.ReportMetric(float64(c.maxLog), "max-log-frames")
+			b.ReportMetric(float64(c.truncates), "truncates")
+			b.ReportMetric(float64(c.busyTruncates), "busy-truncates")
+			reportLatencies(b, lats, "write-")
+		})
+	}
+}
+
+// readInTx reads a post inside a read transaction that stays open for hold.
+func readInTx(db *sql.DB, hold time.Duration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := readAnyPost(tx); err != nil {
+		return err
+	}
+	time.Sleep(hold)
+	return tx.Commit()
+}
+
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// readAnyPost reads whichever post SQLite returns first, without an order
+// by, so the result depends on the order it happens to scan posts in.
+func readAnyPost(q queryer) (string, error) {
+	rows, err := q.Query(`select content from posts limit 1`)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		return "", sql.ErrNoRows
+	}
+	var content string
+	if err := rows.Scan(&content); err != nil {
+		return "", err
+	}
+	return content, rows.Close()
+}
+
+// scanPosts reads all posts in pages of pageSize rows using keyset
+// pagination and returns the number of rows read.
+func scanPosts(q queryer, pageSize int) (int, error) {
+	lastID, total := int64(0), 0
+	for {
+		rows, err := q.Query(`select id, content from posts where id > ? order by id limit ?`, lastID, pageSize)
+		if err != nil {
+			return total, err
+		}
+		n := 0
+		for rows.Next() {
+			var content string
+			if err := rows.Scan(&lastID, &content); err != nil {
+				rows.Close()
+				return total, err
+			}
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		total += n
+		if n < pageSize {
+			return total, nil
+		}
+	}
+}
+
+// BenchmarkSnapshotVsShortReads scans the posts table page by page while a
+// writer keeps inserting. mode=snapshot reads all pages in one read
+// transaction, so it sees a consistent snapshot but keeps the WAL from being
+// checkpointed. mode=short reads every page separately and sees rows inserted
+// during the scan. One op is one full scan.
+func BenchmarkSnapshotVsShortReads(b *testing.B) {
+	for _, mode := range []string{"snapshot", "short"} {
+		b.Run(fmt.Sprintf("mode=%s", mode), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			db := makeDBAt(b, dbPath, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			content := strings.Repeat("A", 1000)
+			noErr(b, insertRowsLoop(db, content, 20000))
+
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if err := writeBlogPost(db, content); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+
+			var rowsRead int
+			var walMax int64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var n int
+				var err error
+				if mode == "snapshot" {
+					var tx *sql.Tx
+					tx, err = db.Begin()
+					noErr(b, err)
+					n, err = scanPosts(tx, 100)
+					walMax = max(walMax, fileSize(dbPath+"-wal"))
+					tx.Rollback()
+				} else {
+					n, err = scanPosts(db, 100)
+				}
+				noErr(b, err)
+				rowsRead += n
+				walMax = max(walMax, fileSize(dbPath+"-wal"))
+			}
+			b.StopTimer()
+			close(done)
+			wg.Wait()
+			b.ReportMetric(float64(rowsRead)/b.Elapsed().Seconds(), "rows/s")
+			b.ReportMetric(float64(walMax), "wal-max-bytes")
+		})
+	}
+}
+
+// walFrames converts a WAL file size to the number of frames (pages) in it.
+// Every frame is a page plus a 24-byte frame header after the 32-byte WAL
+// header.
+func walFrames(size int64, pageSize int) int64 {
+	if size < 32 {
+		return 0
+	}
+	return (size - 32) / int64(pageSize+24)
+}
+
+// BenchmarkReadTxPinsWAL inserts rows one transaction at a time while a read
+// transaction is held open for hold, and reports the largest number of WAL
+// pages seen per op. The auto-checkpoint runs as usual, but it can't reset
+// the WAL while the reader pins an old snapshot, so the WAL keeps growing.
+// hold=none runs without the reader. hold=all keeps the reader open until
+// all rows are written. Each op truncates the WAL before starting.
+func BenchmarkReadTxPinsWAL(b *testing.B) {
+	for _, k := range []int{100, 1000, 10000} {
+		for _, hold := range []time.Duration{0, 10 * time.Millisecond, 100 * time.Millisecond, -1} {
+			name := hold.String()
+			switch {
+			case hold == 0:
+				name = "none"
+			case hold < 0:
+				name = "all"
+			}
+			b.Run(fmt.Sprintf("rows=%d&hold=%s", k, name), func(b *testing.B) {
+				dbPath := path.Join(b.TempDir(), "benchmark.db")
+				db := makeDBAt(b, dbPath, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				db.SetMaxOpenConns(2)
+				noErr(b, writeBlogPost(db, "A"))
+				var pageSize int
+				noErr(b, db.QueryRow(`pragma page_size`).Scan(&pageSize))
+				content := strings.Repeat("A", 1000)
+
+				var frames int64
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					_, _, _, err := checkpointStats(db, "TRUNCATE")
+					noErr(b, err)
+					b.StartTimer()
+
+					var tx *sql.Tx
+					var holdUntil time.Time
+					if hold != 0 {
+						tx, err = db.Begin()
+						noErr(b, err)
+						_, err = tx.Exec(`select count(*) from posts`)
+						noErr(b, err)
+						holdUntil = time.Now().Add(hold)
+					}
+					var walMax int64
+					for j := 0; j < k; j++ {
+						noErr(b, writeBlogPost(db, content))
+						if tx != nil && hold > 0 && time.Now().After(holdUntil) {
+							noErr(b, tx.Rollback())
+							tx = nil
+						}
+						if j%10 == 0 {
+							walMax = max(walMax, fileSize(dbPath+"-wal"))
+						}
+					}
+					walMax = max(walMax, fileSize(dbPath+"-wal"))
+					if tx != nil {
+						noErr(b, tx.Rollback())
+					}
+					frames += walFrames(walMax, pageSize)
+				}
+				b.ReportMetric(float64(frames)/float64(b.N), "wal-pages")
+			})
+		}
+	}
+}
+
+// BenchmarkCheckpointStarvation writes at a steady rate with
+// auto-checkpointing disabled while two readers take turns holding 50ms read
+// transactions, so that one of them is always active. A background
+// connection runs a checkpoint of the given mode every 10ms. PASSIVE never
+// waits for readers, so the WAL can't be restarted and keeps growing.
+// RESTART waits for the readers of the old WAL to finish, which lets the
+// next writer start over at the beginning of the WAL, but it blocks writers
+// while it waits. wal-growth-bytes/s is how fast the WAL file grew over the
+// run. PASSIVE doesn't report busy when readers stop it from copying
+// everything, so max-behind-frames shows the most frames a checkpoint left
+// in the WAL uncopied.
+func BenchmarkCheckpointStarvation(b *testing.B) {
+	for _, mode := range []string{"PASSIVE", "RESTART"} {
+		b.Run(fmt.Sprintf("mode=%s", mode), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			db := makeDBAt(b, dbPath, options)
+			db.SetMaxOpenConns(1)
+			_, err := db.Exec(`pragma wal_autocheckpoint=0`)
+			noErr(b, err)
+			noErr(b, writeBlogPost(db, "A"))
+			readDB, err := sql.Open("sqlite3", dbPath+options)
+			noErr(b, err)
+			defer readDB.Close()
+			ckptDB, err := sql.Open("sqlite3", dbPath+"?_journal=WAL&_timeout=1000")
+			noErr(b, err)
+			defer ckptDB.Close()
+
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			for r := 0; r < 2; r++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					time.Sleep(time.Duration(r) * 25 * time.Millisecond)
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						if err := readInTx(readDB, 50*time.Millisecond); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			var busyCount, maxBehind int
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ticker := time.NewTicker(10 * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+					}
+					busy, log, ckpt, err := checkpointStats(ckptDB, mode)
+					if isBusy(err) {
+						busy, err = 1, nil
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					busyCount += busy
+					maxBehind = max(maxBehind, log-ckpt)
+				}
+			}()
+
+			content := strings.Repeat("A", 1000)
+			walStart := fileSize(dbPath + "-wal")
+			var walMax int64
+			lats := make(latencies, 0, b.N)
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if d := time.Until(start.Add(time.Duration(i) * steadyWriteInterval)); d > 0 {
+					time.Sleep(d)
+				}
+				t := time.Now()
+				err := writeBlogPost(db, content)
+				lats = append(lats, time.Since(t))
+				noErr(b, err)
+				if i%100 == 0 {
+					walMax = max(walMax, fileSize(dbPath+"-wal"))
+				}
+			}
+			b.StopTimer()
+			elapsed := time.Since(start)
+			close(done)
+			wg.Wait()
+
+			walFinal := fileSize(dbPath + "-wal")
+			b.ReportMetric(float64(walFinal-walStart)/elapsed.Seconds(), "wal-growth-bytes/s")
+			b.ReportMetric(float64(max(walMax, walFinal)), "wal-max-bytes")
+			b.ReportMetric(float64(maxBehind), "max-behind-frames")
+			b.ReportMetric(float64(busyCount), "busy-checkpoints")
+			reportLatencies(b, lats, "write-")
+		})
+	}
+}
+
+// BenchmarkReadWithCheckpointer reads posts by id while a background writer
+// writes at a steady rate. mode=auto leaves checkpointing to the writer's
+// auto-checkpoint every 1000 pages, mode=external disables it and runs a
+// PASSIVE checkpoint every second from a separate connection. Readers never
+// wait for checkpoints, but a longer WAL makes every page lookup go through
+// a bigger wal-index.
+func BenchmarkReadWithCheckpointer(b *testing.B) {
+	for _, mode := range []string{"auto", "external"} {
+		b.Run(fmt.Sprintf("mode=%s", mode), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			writeDB := makeDBAt(b, dbPath, options)
+			writeDB.SetMaxOpenConns(1)
+			const rows = 10000
+			content := strings.Repeat("A", 1000)
+			noErr(b, insertRowsLoop(writeDB, content, rows))
+			if mode == "external" {
+				_, err := writeDB.Exec(`pragma wal_autocheckpoint=0`)
+				noErr(b, err)
+			}
+			readDB, err := sql.Open("sqlite3", dbPath+options)
+			noErr(b, err)
+			defer readDB.Close()
+			ckptDB, err := sql.Open("sqlite3", dbPath+options)
+			noErr(b, err)
+			defer ckptDB.Close()
+
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if d := time.Until(start.Add(time.Duration(i) * steadyWriteInterval)); d > 0 {
+						time.Sleep(d)
+					}
+					if err := writeBlogPost(writeDB, content); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+			if mode == "external" {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ticker := time.NewTicker(time.Second)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-done:
+							return
+						case <-ticker.C:
+						}
+						if _, _, _, err := checkpointStats(ckptDB, "PASSIVE"); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+
+			lats := make(latencies, 0, b.N)
+			var walMax int64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				t := time.Now()
+				_, err := readBlogPostByID(readDB, int64(i%rows+1))
+				lats = append(lats, time.Since(t))
+				noErr(b, err)
+				if i%1000 == 0 {
+					walMax = max(walMax, fileSize(dbPath+"-wal"))
+				}
+			}
+			b.StopTimer()
+			close(done)
+			wg.Wait()
+			b.ReportMetric(float64(walMax), "wal-max-bytes")
+			reportLatencies(b, lats, "read-")
+		})
+	}
+}
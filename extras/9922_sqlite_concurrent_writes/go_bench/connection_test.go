@@ -0,0 +1,673 @@
+package sqlite_bench
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// dsnPragmas are the DSN options go-sqlite3 turns into PRAGMA statements
+// only when they're in the DSN. It also sets busy_timeout, locking_mode and
+// synchronous on every connection regardless of the DSN, so _timeout,
+// _locking_mode and _synchronous aren't listed.
+var dsnPragmas = []string{
+	"_journal=WAL",
+	"_fk=true",
+	"_cache_size=-2000",
+	"_cslike=false",
+	"_defer_foreign_keys=false",
+	"_ignore_check_constraints=false",
+	"_query_only=false",
+	"_recursive_triggers=false",
+	"_secure_delete=false",
+	"_writable_schema=false",
+	"_auto_vacuum=none",
+}
+
+// BenchmarkOpenWithDSNPragmas measures the cost of opening a connection and
+// running the first query as the number of DSN pragmas grows. pragmas is
+// the number the DSN adds to the three go-sqlite3 always runs, so pragmas=0
+// is the baseline. Each op opens a new *sql.DB, so every pragma is applied
+// once per op.
+func BenchmarkOpenWithDSNPragmas(b *testing.B) {
+	dbPath := path.Join(b.TempDir(), "benchmark.db")
+	db := makeDBAt(b, dbPath, "?_journal=WAL")
+	db.Close()
+	for n := 0; n <= len(dsnPragmas); n++ {
+		b.Run(fmt.Sprintf("pragmas=%d", n), func(b *testing.B) {
+			options := "?" + strings.Join(dsnPragmas[:n], "&")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				db, err := sql.Open("sqlite3", dbPath+options)
+				noErr(b, err)
+				var one int
+				err = db.QueryRow(`select 1`).Scan(&one)
+				noErr(b, err)
+				noErr(b, db.Close())
+			}
+		})
+	}
+}
+
+// BenchmarkPreparedStatementAffinity compares a *sql.Stmt prepared on the pool
+// with a statement prepared on a pinned *sql.Conn. With MaxIdleConns=1,
+// 8 parallel goroutines per CPU keep closing and opening connections, and
+// the pooled statement has to be re-prepared on each new connection it
+// lands on. prepares/op is the number of prepares the driver did, which is
+// the re-preparation the pinned statements avoid: they're prepared once per
+// goroutine, before the timer starts counting them.
+func BenchmarkPreparedStatementAffinity(b *testing.B) {
+	for _, mode := range []string{"pooled", "pinned"} {
+		b.Run(fmt.Sprintf("mode=%s", mode), func(b *testing.B) {
+			dsn := path.Join(b.TempDir(), "benchmark.db") + "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			var prepares atomic.Int64
+			db := sql.OpenDB(prepareCountingConnector{dsn, &sqlite3.SQLiteDriver{}, &prepares})
+			defer db.Close()
+			noErr(b, setupDB(db))
+			noErr(b, insertRowsLoop(db, strings.Repeat("A", 100), 1000))
+			db.SetMaxIdleConns(1)
+			query := `select content from posts where id = ?`
+			var stmt *sql.Stmt
+			if mode == "pooled" {
+				var err error
+				stmt, err = db.Prepare(query)
+				noErr(b, err)
+				defer stmt.Close()
+			}
+			prepares.Store(0)
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ctx := context.Background()
+				s := stmt
+				if mode == "pinned" {
+					conn, err := db.Conn(ctx)
+					noErr(b, err)
+					defer conn.Close()
+					s, err = conn.PrepareContext(ctx, query)
+					noErr(b, err)
+					defer s.Close()
+				}
+				var content string
+				for i := 0; pb.Next(); i++ {
+					rows, err := s.QueryContext(ctx, i%1000+1)
+					noErr(b, err)
+					// Yield while holding the connection and after releasing
+					// it, as a handler doing other work would, so the
+					// goroutines overlap even on one CPU.
+					runtime.Gosched()
+					for rows.Next() {
+						noErr(b, rows.Scan(&content))
+					}
+					noErr(b, rows.Close())
+					runtime.Gosched()
+				}
+			})
+			b.StopTimer()
+			b.ReportMetric(float64(prepares.Load())/float64(b.N), "prepares/op")
+		})
+	}
+}
+
+// BenchmarkConnMaxIdleTimeWALCleanup writes from several goroutines, then
+// idles, and reports the -wal and -shm sizes after the idle period.
+// SQLite checkpoints and deletes both files when the last connection to the
+// database closes, which only happens if idle connections are reaped.
+// database/sql checks for idle connections at most once a second.
+func BenchmarkConnMaxIdleTimeWALCleanup(b *testing.B) {
+	for _, idleTime := range []time.Duration{0, 100 * time.Millisecond} {
+		name := idleTime.String()
+		if idleTime == 0 {
+			name = "none"
+		}
+		b.Run(fmt.Sprintf("max_idle_time=%s", name), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			db := makeDBAt(b, dbPath, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			defer db.Close()
+			db.SetConnMaxIdleTime(idleTime)
+			content := strings.Repeat("A", 1000)
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					err := writeBlogPost(db, content)
+					noErr(b, err)
+				}
+			})
+			b.StopTimer()
+			b.ReportMetric(float64(fileSize(dbPath+"-wal")), "wal-bytes-before-idle")
+			time.Sleep(time.Second + 2*idleTime)
+			b.ReportMetric(float64(db.Stats().OpenConnections), "open-conns-after-idle")
+			b.ReportMetric(float64(fileSize(dbPath+"-wal")), "wal-bytes-after-idle")
+			b.ReportMetric(float64(fileSize(dbPath+"-shm")), "shm-bytes-after-idle")
+		})
+	}
+}
+
+// BenchmarkCloseWithPreparedStatements prepares n distinct statements on a
+// connection and measures closing them and the connection. Closing a
+// statement finalizes it in SQLite, and database/sql keeps the connection
+// open until all of its statements are closed, so applications with many
+// distinct query texts pay for each of them. Only the close is timed.
+func BenchmarkCloseWithPreparedStatements(b *testing.B) {
+	dbPath := path.Join(b.TempDir(), "benchmark.db")
+	options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+	makeDBAt(b, dbPath, options).Close()
+	for _, n := range []int{0, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("statements=%d", n), func(b *testing.B) {
+			ctx := context.Background()
+			var closeTime time.Duration
+			for i := 0; i < b.N; i++ {
+				db, err := sql.Open("sqlite3", dbPath+options)
+				noErr(b, err)
+				conn, err := db.Conn(ctx)
+				noErr(b, err)
+				stmts := make([]*sql.Stmt, n)
+				for j := range stmts {
+					stmts[j], err = conn.PrepareContext(ctx, fmt.Sprintf(`select content from posts where id = %d`, j))
+					noErr(b, err)
+				}
+				noErr(b, conn.Close())
+				t := time.Now()
+				for _, stmt := range stmts {
+					noErr(b, stmt.Close())
+				}
+				noErr(b, db.Close())
+				closeTime += time.Since(t)
+			}
+			b.ReportMetric(float64(closeTime.Nanoseconds())/float64(b.N), "close-ns")
+		})
+	}
+}
+
+// semaphore bounds concurrency like golang.org/x/sync/semaphore with
+// weight 1.
+type semaphore chan struct{}
+
+func (s semaphore) acquire() { s <- struct{}{} }
+func (s semaphore) release() { <-s }
+
+// BenchmarkSemaphoreVsMaxOpenConns bounds 16 goroutines running a mix of
+// 80% point reads and 20% writes to limit concurrent queries, with a Go
+// semaphore around every query, with SetMaxOpenConns, or both. With both,
+// the smaller limit wins, and pool-waits shows how many queries got past
+// the semaphore only to wait for a connection inside database/sql.
+// Goroutines take ops from a shared counter, as in
+// BenchmarkWriteSerialization. Should be used with -cpu=1.
+func BenchmarkSemaphoreVsMaxOpenConns(b *testing.B) {
+	const concurrency, limit, rows = 16, 4, 10000
+	modes := []struct {
+		name          string
+		sem, maxConns int
+	}{
+		{"none", 0, 0},
+		{"max-open-conns", 0, limit},
+		{"semaphore", limit, 0},
+		{"both", limit, limit},
+		{"semaphore-above-pool", 2 * limit, limit},
+	}
+	for _, mode := range modes {
+		b.Run(fmt.Sprintf("mode=%s&limit=%d", mode.name, limit), func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			content := strings.Repeat("A", 1000)
+			noErr(b, insertRowsLoop(db, content, rows))
+			db.SetMaxOpenConns(mode.maxConns)
+			var sem semaphore
+			if mode.sem > 0 {
+				sem = make(semaphore, mode.sem)
+			}
+			var ops atomic.Int64
+			counts := make([]int64, concurrency)
+			perWorker := make([]latencies, concurrency)
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for w := 0; w < concurrency; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := ops.Add(1); i <= int64(b.N); i = ops.Add(1) {
+						t := time.Now()
+						if sem != nil {
+							sem.acquire()
+						}
+						var err error
+						if i%5 == 0 {
+							err = writeBlogPost(db, content)
+						} else {
+							_, err = readBlogPostByID(db, i%rows+1)
+						}
+						if sem != nil {
+							sem.release()
+						}
+						perWorker[w] = append(perWorker[w], time.Since(t))
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						counts[w]++
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+			var lats latencies
+			for _, l := range perWorker {
+				lats = append(lats, l...)
+			}
+			stats := db.Stats()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+			reportLatencies(b, lats, "op-")
+			b.ReportMetric(jainFairness(counts), "fairness")
+			b.ReportMetric(float64(stats.WaitCount), "pool-waits")
+			b.ReportMetric(float64(stats.MaxOpenConnections), "max-open-conns")
+		})
+	}
+}
+
+// BenchmarkTxStmtRebind compares ways of running a prepared insert inside a
+// transaction of n inserts. tx-stmt prepares once on the pool and rebinds the
+// statement with tx.Stmt in every transaction, which reuses the statement if
+// it was already prepared on the transaction's connection. tx-prepare
+// prepares it in every transaction. tx-exec doesn't prepare explicitly.
+func BenchmarkTxStmtRebind(b *testing.B) {
+	const query = `insert into posts (content) values (?)`
+	for _, n := range []int{1, 10, 100} {
+		for _, method := range []string{"tx-stmt", "tx-prepare", "tx-exec"} {
+			b.Run(fmt.Sprintf("method=%s&inserts=%d", method, n), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				stmt, err := db.Prepare(query)
+				noErr(b, err)
+				defer stmt.Close()
+				content := strings.Repeat("A", 1000)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					tx, err := db.Begin()
+					noErr(b, err)
+					var s *sql.Stmt
+					switch method {
+					case "tx-stmt":
+						s = tx.Stmt(stmt)
+					case "tx-prepare":
+						s, err = tx.Prepare(query)
+						noErr(b, err)
+					}
+					for j := 0; j < n; j++ {
+						if s != nil {
+							_, err = s.Exec(content)
+						} else {
+							_, err = tx.Exec(query, content)
+						}
+						noErr(b, err)
+					}
+					noErr(b, tx.Commit())
+					if s != nil {
+						s.Close()
+					}
+				}
+			})
+		}
+	}
+}
+
+// warmPool opens n connections in db's pool up front. Sequential Pings
+// would reuse one connection, so it checks out n at once before returning
+// them. The pool keeps only MaxIdleConns of them, 2 by default, so set that
+// to at least n first.
+func warmPool(db *sql.DB, n int) error {
+	ctx := context.Background()
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+		if err := conn.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BenchmarkPoolWarmup opens a new pool, optionally warms it with warmPool,
+// and then runs a burst of one point read from each of n goroutines. One op
+// is one burst, and only the burst is timed. On a cold pool, every
+// goroutine that finds no idle connection opens its own, which includes
+// running the DSN pragmas. Should be used with -cpu=1.
+func BenchmarkPoolWarmup(b *testing.B) {
+	dbPath := path.Join(b.TempDir(), "benchmark.db")
+	options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+	db := makeDBAt(b, dbPath, options)
+	noErr(b, insertRowsLoop(db, strings.Repeat("A", 1000), 1000))
+	noErr(b, db.Close())
+	for _, n := range []int{4, 16} {
+		for _, warm := range []bool{false, true} {
+			b.Run(fmt.Sprintf("burst=%d&warm=%t", n, warm), func(b *testing.B) {
+				var lats latencies
+				var mu sync.Mutex
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					db, err := sql.Open("sqlite3", dbPath+options)
+					noErr(b, err)
+					db.SetMaxIdleConns(n)
+					if warm {
+						noErr(b, warmPool(db, n))
+					}
+					var wg sync.WaitGroup
+					b.StartTimer()
+					for g := 0; g < n; g++ {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							t := time.Now()
+							_, err := readBlogPostByID(db, int64(g+1))
+							mu.Lock()
+							lats = append(lats, time.Since(t))
+							mu.Unlock()
+							if err != nil {
+								b.Error(err)
+							}
+						}()
+					}
+					wg.Wait()
+					b.StopTimer()
+					noErr(b, db.Close())
+				}
+				reportLatencies(b, lats, "query-")
+			})
+		}
+	}
+}
+
+// prepareCountingConnector opens go-sqlite3 connections that count explicit
+// prepares, the ones database/sql makes for db.Prepare, tx.Prepare and
+// tx.Stmt. go-sqlite3 also prepares internally on every Exec and Query with
+// a query string, which isn't counted.
+type prepareCountingConnector struct {
+	dsn      string
+	driver   *sqlite3.SQLiteDriver
+	prepares *atomic.Int64
+}
+
+func (c prepareCountingConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return prepareCountingConn{conn.(*sqlite3.SQLiteConn), c.prepares}, nil
+}
+
+func (c prepareCountingConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type prepareCountingConn struct {
+	*sqlite3.SQLiteConn
+	prepares *atomic.Int64
+}
+
+func (c prepareCountingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	c.prepares.Add(1)
+	return c.SQLiteConn.PrepareContext(ctx, query)
+}
+
+// BenchmarkStmtAcrossTransactions runs short transactions of one insert
+// from concurrent goroutines, with a statement prepared once on the pool
+// and rebound with tx.Stmt, or prepared in every transaction. tx.Stmt
+// prepares the statement again only on connections it hasn't been prepared
+// on yet, so prepares/op, the number of prepares the driver did, stays near
+// zero as long as the pool keeps its connections; see
+// BenchmarkPreparedStatementAffinity for a pool that doesn't. Statements
+// from tx.Stmt and tx.Prepare are closed on commit. Should be used with
+// -cpu=1.
+func BenchmarkStmtAcrossTransactions(b *testing.B) {
+	const query = `insert into posts (content) values (?)`
+	for _, concurrency := range []int{1, 4} {
+		for _, method := range []string{"tx-stmt", "tx-prepare"} {
+			b.Run(fmt.Sprintf("concurrency=%d&method=%s", concurrency, method), func(b *testing.B) {
+				dsn := path.Join(b.TempDir(), "benchmark.db") + "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+				var prepares atomic.Int64
+				db := sql.OpenDB(prepareCountingConnector{dsn, &sqlite3.SQLiteDriver{}, &prepares})
+				defer db.Close()
+				noErr(b, setupDB(db))
+				stmt, err := db.Prepare(query)
+				noErr(b, err)
+				defer stmt.Close()
+				content := strings.Repeat("A", 1000)
+				prepares.Store(0)
+				b.SetParallelism(concurrency)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						tx, err := db.Begin()
+						noErr(b, err)
+						var s *sql.Stmt
+						if method == "tx-stmt" {
+							s = tx.Stmt(stmt)
+						} else {
+							s, err = tx.Prepare(query)
+							noErr(b, err)
+						}
+						_, err = s.Exec(content)
+						noErr(b, err)
+						noErr(b, tx.Commit())
+					}
+				})
+				b.StopTimer()
+				b.ReportMetric(float64(prepares.Load())/float64(b.N), "prepares/op")
+			})
+		}
+	}
+}
+
+// BenchmarkFirstQueryAfterIdle writes a post, leaves the database idle and
+// times the first read after that. mode=keep keeps the *sql.DB and its idle
+// connection. mode=reaped keeps the *sql.DB but sets ConnMaxIdleTime below
+// the idle period, so the pool closes the connection and the read opens a
+// new one. database/sql closes idle connections at most once a second, so
+// the idle period is a bit longer than that. mode=reopen closes the *sql.DB
+// before the idle period and opens a new one after it. When the last
+// connection to a database closes, SQLite checkpoints the WAL and deletes
+// it, so after reaped and reopen the next connection also recreates the WAL
+// and the shared-memory index; wal-kept reports the share of ops where the
+// WAL file still existed after the idle period. Should be used with
+// -benchtime=10x, since every op sleeps.
+func BenchmarkFirstQueryAfterIdle(b *testing.B) {
+	const idle = 1100 * time.Millisecond
+	for _, mode := range []string{"keep", "reaped", "reopen"} {
+		b.Run(fmt.Sprintf("mode=%s", mode), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			db := makeDBAt(b, dbPath, options)
+			content := strings.Repeat("A", 1000)
+			noErr(b, insertRowsLoop(db, content, 1000))
+			if mode == "reaped" {
+				db.SetConnMaxIdleTime(idle / 10)
+			}
+			walKept := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				noErr(b, writeBlogPost(db, content))
+				if mode == "reopen" {
+					noErr(b, db.Close())
+				}
+				time.Sleep(idle)
+				if _, err := os.Stat(dbPath + "-wal"); err == nil {
+					walKept++
+				}
+				if mode == "reopen" {
+					var err error
+					db, err = sql.Open("sqlite3", dbPath+options)
+					noErr(b, err)
+				}
+				b.StartTimer()
+				_, err := readBlogPostByID(db, int64(i%1000+1))
+				noErr(b, err)
+			}
+			b.StopTimer()
+			noErr(b, db.Close())
+			b.ReportMetric(float64(walKept)/float64(b.N), "wal-kept")
+		})
+	}
+}
+
+// busyTimeouts checks out n connections from db at once and returns the
+// busy_timeout of each.
+func busyTimeouts(db *sql.DB, n int) ([]int, error) {
+	ctx := context.Background()
+	timeouts := make([]int, n)
+	for i := range timeouts {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if err := conn.QueryRowContext(ctx, `pragma busy_timeout`).Scan(&timeouts[i]); err != nil {
+			return nil, err
+		}
+	}
+	return timeouts, nil
+}
+
+// TestBusyTimeoutPerConnection checks the busy_timeout of every connection
+// in a pool of 4. go-sqlite3 sets busy_timeout on every connection it opens,
+// to _timeout from the DSN or to 5000 ms if the DSN has none. A PRAGMA
+// busy_timeout run through db.Exec only changes the connection that
+// happened to run it, while one run in a ConnectHook applies to all.
+func TestBusyTimeoutPerConnection(t *testing.T) {
+	const n = 4
+	dbPath := path.Join(t.TempDir(), "test.db")
+	makeDBAt(t, dbPath, "?_journal=WAL").Close()
+	tests := []struct {
+		name string
+		open func() (*sql.DB, error)
+		want []int
+	}{
+		{"dsn", func() (*sql.DB, error) {
+			return sql.Open("sqlite3", dbPath+"?_journal=WAL&_timeout=1234")
+		}, []int{1234, 1234, 1234, 1234}},
+		{"exec", func() (*sql.DB, error) {
+			db, err := sql.Open("sqlite3", dbPath+"?_journal=WAL")
+			if err == nil {
+				_, err = db.Exec(`pragma busy_timeout=1234`)
+			}
+			return db, err
+		}, []int{1234, 5000, 5000, 5000}},
+		{"connect-hook", func() (*sql.DB, error) {
+			return openWithPragmas(dbPath+"?_journal=WAL", "busy_timeout=1234"), nil
+		}, []int{1234, 1234, 1234, 1234}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := tt.open()
+			noErr(t, err)
+			defer db.Close()
+			timeouts, err := busyTimeouts(db, n)
+			noErr(t, err)
+			if !slices.Equal(timeouts, tt.want) {
+				t.Errorf("got busy_timeout %v, want %v", timeouts, tt.want)
+			}
+		})
+	}
+}
+
+// hookPragmas are cheap pragmas a ConnectHook might run, most of them
+// setting what's already the default.
+var hookPragmas = []string{
+	"journal_mode=WAL",
+	"synchronous=normal",
+	"foreign_keys=on",
+	"busy_timeout=5000",
+	"cache_size=-2000",
+	"temp_store=default",
+	"mmap_size=0",
+	"automatic_index=on",
+	"case_sensitive_like=off",
+	"recursive_triggers=off",
+	"secure_delete=off",
+	"cell_size_check=off",
+	"trusted_schema=on",
+	"wal_autocheckpoint=1000",
+	"analysis_limit=0",
+}
+
+// BenchmarkConnectHookCost opens and closes a driver connection, without
+// database/sql, with a ConnectHook that runs the first n of hookPragmas or
+// registers n Go functions. With SQLITE_BENCH_EXTENSION set to the path of
+// a SQLite extension, it also benchmarks a hook that loads it, which needs
+// a build without sqlite_omit_load_extension. open-ns is the time to open
+// and run the hook, close-ns the time to close. Another connection stays
+// open throughout, as in a pool, so that closing the benchmarked one isn't
+// the last close that checkpoints and deletes the WAL.
+func BenchmarkConnectHookCost(b *testing.B) {
+	dbPath := path.Join(b.TempDir(), "benchmark.db")
+	dsn := dbPath + "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+	keep := makeDBAt(b, dbPath, "?_journal=WAL")
+	defer keep.Close()
+	noErr(b, readBlogPost(keep))
+	type hookCase struct {
+		name string
+		hook func(*sqlite3.SQLiteConn) error
+	}
+	cases := []hookCase{{"none", nil}}
+	for _, n := range []int{5, 15} {
+		cases = append(cases, hookCase{fmt.Sprintf("pragmas-%d", n), func(conn *sqlite3.SQLiteConn) error {
+			for _, pragma := range hookPragmas[:n] {
+				if _, err := conn.Exec("pragma "+pragma, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		}})
+	}
+	for _, n := range []int{1, 10} {
+		cases = append(cases, hookCase{fmt.Sprintf("funcs-%d", n), func(conn *sqlite3.SQLiteConn) error {
+			for i := 0; i < n; i++ {
+				if err := conn.RegisterFunc(fmt.Sprintf("f%d", i), strings.ToUpper, true); err != nil {
+					return err
+				}
+			}
+			return nil
+		}})
+	}
+	if ext := os.Getenv("SQLITE_BENCH_EXTENSION"); ext != "" {
+		cases = append(cases, hookCase{"extension", func(conn *sqlite3.SQLiteConn) error {
+			return conn.LoadExtension(ext, "")
+		}})
+	}
+	for _, c := range cases {
+		b.Run(fmt.Sprintf("hook=%s", c.name), func(b *testing.B) {
+			drv := &sqlite3.SQLiteDriver{ConnectHook: c.hook}
+			var openTime, closeTime time.Duration
+			for i := 0; i < b.N; i++ {
+				t := time.Now()
+				conn, err := drv.Open(dsn)
+				noErr(b, err)
+				openTime += time.Since(t)
+				t = time.Now()
+				noErr(b, conn.Close())
+				closeTime += time.Since(t)
+			}
+			b.ReportMetric(float64(openTime.Nanoseconds())/float64(b.N), "open-ns")
+			b.ReportMetric(float64(closeTime.Nanoseconds())/float64(b.N), "close-ns")
+		})
+	}
+}
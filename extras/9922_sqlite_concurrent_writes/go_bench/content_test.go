@@ -0,0 +1,65 @@
+package sqlite_bench
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"strings"
+	"testing"
+)
+
+var words = strings.Fields(`
+	sqlite write ahead log page cache checkpoint reader writer lock busy
+	timeout journal synchronous normal full transaction commit rollback index
+	table column row blob text integer real vacuum pragma statement connection`)
+
+// makeContent returns size bytes of content with the given entropy:
+// low is a repeated character, medium is random words and high is random
+// bytes, stored as a blob.
+func makeContent(entropy string, size int) any {
+	switch entropy {
+	case "low":
+		return strings.Repeat("A", size)
+	case "medium":
+		var sb strings.Builder
+		for sb.Len() < size {
+			sb.WriteString(words[rand.IntN(len(words))])
+			sb.WriteByte(' ')
+		}
+		return sb.String()[:size]
+	default:
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(rand.UintN(256))
+		}
+		return content
+	}
+}
+
+// BenchmarkWriteDifferentEntropy writes content of the same length but
+// different entropy. SQLite stores values as is, so the DB size should only
+// depend on length. The contents are generated before the timer starts.
+func BenchmarkWriteDifferentEntropy(b *testing.B) {
+	for _, entropy := range []string{"low", "medium", "high"} {
+		for _, size := range []int{100, 1000, 10000} {
+			b.Run(fmt.Sprintf("entropy=%s&size=%db", entropy, size), func(b *testing.B) {
+				dbPath := path.Join(b.TempDir(), "benchmark.db")
+				db := makeDBAt(b, dbPath, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				contents := make([]any, 64)
+				for i := range contents {
+					contents[i] = makeContent(entropy, size)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_, err := db.Exec(`insert into posts (content) values (?)`, contents[i%len(contents)])
+					noErr(b, err)
+				}
+				b.StopTimer()
+				_, err := db.Exec(`pragma wal_checkpoint(TRUNCATE)`)
+				noErr(b, err)
+				b.ReportMetric(float64(fileSize(dbPath)), "db-bytes")
+				b.ReportMetric(float64(fileSize(dbPath))/float64(b.N), "db-bytes/row")
+			})
+		}
+	}
+}
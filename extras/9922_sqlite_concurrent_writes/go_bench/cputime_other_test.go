@@ -0,0 +1,12 @@
+//go:build !unix
+
+package sqlite_bench
+
+import (
+	"errors"
+	"time"
+)
+
+func cpuTime() (time.Duration, error) {
+	return 0, errors.New("getrusage is not supported on this platform")
+}
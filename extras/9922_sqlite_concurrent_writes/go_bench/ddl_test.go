@@ -0,0 +1,148 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ddlStatements are pairs of schema changes that undo each other, so they
+// can run in a loop. DROP COLUMN rewrites the whole table.
+var ddlStatements = map[string][2]string{
+	"add-column": {
+		`alter table posts add column extra integer`,
+		`alter table posts drop column extra`,
+	},
+	"create-index": {
+		`create index posts_content on posts (content)`,
+		`drop index posts_content`,
+	},
+}
+
+// runDDL runs the ddl statement pair on db in a loop until done is closed
+// and counts the statements that ran in ran.
+func runDDL(db *sql.DB, ddl string, done <-chan struct{}, ran *atomic.Int64) error {
+	for n := 0; ; n++ {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		if _, err := db.Exec(ddlStatements[ddl][n%2]); err != nil {
+			return err
+		}
+		ran.Add(1)
+	}
+}
+
+// TestReadsDuringDDL runs point reads with a prepared statement while
+// another connection keeps changing the schema. Readers in WAL mode don't
+// wait for the DDL's write lock, and a statement prepared before a schema
+// change is prepared again by SQLite when it next runs, so no read fails.
+// The reads name their columns: a select * would start returning a column
+// more than its Scan expects once the column is added. It reads until the
+// DDL has run both statements at least twice, since with one CPU the reads
+// could otherwise finish before the DDL goroutine starts.
+func TestReadsDuringDDL(t *testing.T) {
+	for ddl := range ddlStatements {
+		t.Run(ddl, func(t *testing.T) {
+			dbPath := path.Join(t.TempDir(), "test.db")
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			db := makeDBAt(t, dbPath, options)
+			defer db.Close()
+			noErr(t, insertRowsLoop(db, strings.Repeat("A", 100), 10000))
+			ddlDB, err := sql.Open("sqlite3", dbPath+options)
+			noErr(t, err)
+			defer ddlDB.Close()
+			stmt, err := db.Prepare(`select id, content from posts where id = ?`)
+			noErr(t, err)
+			defer stmt.Close()
+
+			done := make(chan struct{})
+			var ddls atomic.Int64
+			var ddlErr error
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ddlErr = runDDL(ddlDB, ddl, done, &ddls)
+			}()
+			deadline := time.Now().Add(10 * time.Second)
+			for i := 0; (i < 2000 || ddls.Load() < 4) && time.Now().Before(deadline); i++ {
+				var id int64
+				var content string
+				if err := stmt.QueryRow(i%10000+1).Scan(&id, &content); err != nil {
+					t.Errorf("read %d: %v", i, err)
+					break
+				}
+				if id != int64(i%10000+1) || len(content) != 100 {
+					t.Errorf("read %d got post %d with %d bytes of content", i, id, len(content))
+					break
+				}
+			}
+			close(done)
+			wg.Wait()
+			noErr(t, ddlErr)
+			if n := ddls.Load(); n < 4 {
+				t.Errorf("only %d DDL statements ran during the reads", n)
+			}
+		})
+	}
+}
+
+// BenchmarkReadDuringDDL measures point reads on a table of 100000 posts
+// while another connection keeps changing its schema. read-availability is
+// the share of reads that succeeded. read-max-ns shows whether any read
+// waited for a DDL statement, though with -cpu=1 it also includes the time
+// the DDL goroutine had the CPU.
+func BenchmarkReadDuringDDL(b *testing.B) {
+	for _, ddl := range []string{"none", "add-column", "create-index"} {
+		b.Run(fmt.Sprintf("ddl=%s", ddl), func(b *testing.B) {
+			const rows = 100000
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			db := makeDBAt(b, dbPath, options)
+			defer db.Close()
+			noErr(b, insertRowsLoop(db, strings.Repeat("A", 100), rows))
+			ddlDB, err := sql.Open("sqlite3", dbPath+options)
+			noErr(b, err)
+			defer ddlDB.Close()
+
+			done := make(chan struct{})
+			var ddls atomic.Int64
+			var wg sync.WaitGroup
+			if ddl != "none" {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := runDDL(ddlDB, ddl, done, &ddls); err != nil {
+						b.Error(err)
+					}
+				}()
+			}
+			lats := make(latencies, 0, b.N)
+			failed := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				t := time.Now()
+				_, err := readBlogPostByID(db, int64(i%rows+1))
+				lats = append(lats, time.Since(t))
+				if err != nil {
+					failed++
+				}
+			}
+			b.StopTimer()
+			close(done)
+			wg.Wait()
+			b.ReportMetric(float64(b.N-failed)/float64(b.N), "read-availability")
+			reportLatencies(b, lats, "read-")
+			b.ReportMetric(float64(lats.percentile(1).Nanoseconds()), "read-max-ns")
+			b.ReportMetric(float64(ddls.Load()), "ddl-statements")
+		})
+	}
+}
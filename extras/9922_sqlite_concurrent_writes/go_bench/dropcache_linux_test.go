@@ -0,0 +1,28 @@
+//go:build linux && (amd64 || arm64)
+
+package sqlite_bench
+
+import (
+	"os"
+	"syscall"
+)
+
+// dropPageCache asks the kernel to drop the file at path from the OS page
+// cache with posix_fadvise(POSIX_FADV_DONTNEED). Only clean pages are
+// dropped, so it syncs the file first.
+func dropPageCache(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	const fadvDontNeed = 4
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
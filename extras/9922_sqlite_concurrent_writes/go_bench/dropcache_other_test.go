@@ -0,0 +1,9 @@
+//go:build !linux || !(amd64 || arm64)
+
+package sqlite_bench
+
+import "errors"
+
+func dropPageCache(string) error {
+	return errors.New("posix_fadvise is not supported on this platform")
+}
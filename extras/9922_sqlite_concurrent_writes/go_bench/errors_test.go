@@ -0,0 +1,231 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// describeError decodes a go-sqlite3 error into its primary and extended
+// result codes and whether retrying the failed statement may succeed.
+// SQLITE_BUSY_SNAPSHOT is not retryable that way: the transaction has to
+// be restarted to get a newer snapshot (see retryOnSnapshot).
+// For errors that don't come from SQLite it returns 0, 0, false.
+func describeError(err error) (code int, ext int, retryable bool) {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return 0, 0, false
+	}
+	code, ext = int(sqliteErr.Code), int(sqliteErr.ExtendedCode)
+	switch {
+	case sqliteErr.ExtendedCode == sqlite3.ErrBusySnapshot:
+		retryable = false
+	case sqliteErr.Code == sqlite3.ErrBusy, sqliteErr.Code == sqlite3.ErrLocked:
+		retryable = true
+	}
+	return code, ext, retryable
+}
+
+func TestDescribeError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		code      sqlite3.ErrNo
+		ext       sqlite3.ErrNoExtended
+		retryable bool
+	}{
+		{"busy", sqlite3.Error{Code: sqlite3.ErrBusy, ExtendedCode: sqlite3.ErrNoExtended(sqlite3.ErrBusy)}, sqlite3.ErrBusy, sqlite3.ErrNoExtended(sqlite3.ErrBusy), true},
+		{"busy recovery", sqlite3.Error{Code: sqlite3.ErrBusy, ExtendedCode: sqlite3.ErrBusyRecovery}, sqlite3.ErrBusy, sqlite3.ErrBusyRecovery, true},
+		{"busy snapshot", sqlite3.Error{Code: sqlite3.ErrBusy, ExtendedCode: sqlite3.ErrBusySnapshot}, sqlite3.ErrBusy, sqlite3.ErrBusySnapshot, false},
+		{"locked", sqlite3.Error{Code: sqlite3.ErrLocked, ExtendedCode: sqlite3.ErrLockedSharedCache}, sqlite3.ErrLocked, sqlite3.ErrLockedSharedCache, true},
+		{"full", sqlite3.Error{Code: sqlite3.ErrFull, ExtendedCode: sqlite3.ErrNoExtended(sqlite3.ErrFull)}, sqlite3.ErrFull, sqlite3.ErrNoExtended(sqlite3.ErrFull), false},
+		{"ioerr", sqlite3.Error{Code: sqlite3.ErrIoErr, ExtendedCode: sqlite3.ErrIoErrWrite}, sqlite3.ErrIoErr, sqlite3.ErrIoErrWrite, false},
+		{"constraint", sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintUnique}, sqlite3.ErrConstraint, sqlite3.ErrConstraintUnique, false},
+		{"wrapped busy", fmt.Errorf("writing post: %w", sqlite3.Error{Code: sqlite3.ErrBusy}), sqlite3.ErrBusy, 0, true},
+		{"not sqlite", errors.New("database is locked"), 0, 0, false},
+		{"nil", nil, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, ext, retryable := describeError(tt.err)
+			if code != int(tt.code) || ext != int(tt.ext) || retryable != tt.retryable {
+				t.Errorf("describeError(%v) = %d, %d, %t, want %d, %d, %t",
+					tt.err, code, ext, retryable, tt.code, tt.ext, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestDescribeErrorFromSQLite(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "test.db")
+	db := makeDBAt(t, dbPath, "?_journal=WAL&_timeout=0")
+	defer db.Close()
+
+	_, err := db.Exec(`insert into posts (id, content) values (1, 'A'), (1, 'B')`)
+	if code, ext, retryable := describeError(err); code != int(sqlite3.ErrConstraint) ||
+		ext != int(sqlite3.ErrConstraintPrimaryKey) || retryable {
+		t.Errorf("duplicate primary key: describeError(%v) = %d, %d, %t", err, code, ext, retryable)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`insert into posts (content) values ('A')`); err != nil {
+		t.Fatal(err)
+	}
+	other, err := sql.Open("sqlite3", dbPath+"?_journal=WAL&_timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	err = writeBlogPost(other, "B")
+	if code, _, retryable := describeError(err); code != int(sqlite3.ErrBusy) || !retryable {
+		t.Errorf("concurrent write: describeError(%v) = %d, %t", err, code, retryable)
+	}
+}
+
+// BenchmarkDescribeError measures the cost of classifying an error, which is
+// paid on every failed statement in retry loops.
+func BenchmarkDescribeError(b *testing.B) {
+	err := fmt.Errorf("writing post: %w", sqlite3.Error{Code: sqlite3.ErrBusy, ExtendedCode: sqlite3.ErrBusySnapshot})
+	for i := 0; i < b.N; i++ {
+		if _, _, retryable := describeError(err); retryable {
+			b.Fatal("busy snapshot is not retryable")
+		}
+	}
+}
+
+func isBusySnapshot(err error) bool {
+	_, ext, _ := describeError(err)
+	return ext == int(sqlite3.ErrBusySnapshot)
+}
+
+// retryOnSnapshot runs txFn in a transaction and restarts the whole
+// transaction if it fails with SQLITE_BUSY_SNAPSHOT. That error means the
+// transaction read from a snapshot that another connection has since
+// written over, so it can't become a write transaction. busy_timeout
+// doesn't help because waiting can't make the snapshot newer. For the same
+// reason, SQLite returns a plain SQLITE_BUSY without waiting if another
+// connection is writing at the moment of the upgrade, so that's restarted
+// too.
+// Starting transactions with BEGIN IMMEDIATE (_txlock=immediate) avoids
+// the error altogether at the cost of serializing the reads too.
+func retryOnSnapshot(db *sql.DB, txFn func(tx *sql.Tx) error) (restarts int, err error) {
+	for attempt := 0; ; attempt++ {
+		err := runTx(db, txFn)
+		if !isBusySnapshot(err) && !isBusy(err) || attempt == 100 {
+			return attempt, err
+		}
+	}
+}
+
+func runTx(db *sql.DB, txFn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := txFn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// readThenWrite is a deferred transaction that reads before it writes, which
+// is what makes BUSY_SNAPSHOT possible.
+func readThenWrite(tx *sql.Tx) error {
+	var count int
+	if err := tx.QueryRow(`select count(*) from posts`).Scan(&count); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`insert into posts (content) values (?)`, fmt.Sprint(count))
+	return err
+}
+
+func TestBusySnapshotNeedsRestart(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "test.db")
+	db := makeDBAt(t, dbPath, "?_journal=WAL&_timeout=1000")
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := readBlogPostTx(tx); err != nil {
+		t.Fatal(err)
+	}
+	// Another connection writes after tx got its snapshot.
+	if err := writeBlogPost(db, "A"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err := tx.Exec(`insert into posts (content) values ('B')`)
+		if !isBusySnapshot(err) {
+			t.Fatalf("statement retry %d: got %v, want SQLITE_BUSY_SNAPSHOT", i, err)
+		}
+	}
+	tx.Rollback()
+
+	restarts, err := retryOnSnapshot(db, readThenWrite)
+	if err != nil {
+		t.Fatalf("after %d restarts: %v", restarts, err)
+	}
+}
+
+func readBlogPostTx(tx *sql.Tx) error {
+	var count int
+	return tx.QueryRow(`select count(*) from posts`).Scan(&count)
+}
+
+// BenchmarkReadThenWriteTx runs concurrent read-then-write transactions.
+// mode=none counts the BUSY_SNAPSHOT and BUSY failures of upgrading to a
+// write transaction, mode=restart retries them with retryOnSnapshot and
+// reports restarts per op, and mode=immediate uses BEGIN IMMEDIATE so they
+// can't happen.
+// Should be used with -cpu=1.
+func BenchmarkReadThenWriteTx(b *testing.B) {
+	for _, mode := range []string{"none", "restart", "immediate"} {
+		for _, concurrency := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("mode=%s&concurrency=%d", mode, concurrency), func(b *testing.B) {
+				options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+				if mode == "immediate" {
+					options += "&_txlock=immediate"
+				}
+				db := makeDB(b, options)
+				var snapshotErrors, busyErrors, restarts atomic.Int64
+				b.SetParallelism(concurrency)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						var err error
+						if mode == "restart" {
+							var n int
+							n, err = retryOnSnapshot(db, readThenWrite)
+							restarts.Add(int64(n))
+						} else {
+							err = runTx(db, readThenWrite)
+						}
+						if isBusySnapshot(err) {
+							snapshotErrors.Add(1)
+						} else if isBusy(err) {
+							busyErrors.Add(1)
+						} else {
+							noErr(b, err)
+						}
+					}
+				})
+				b.ReportMetric(float64(snapshotErrors.Load()), "snapshot-errors")
+				b.ReportMetric(float64(busyErrors.Load()), "busy-errors")
+				b.ReportMetric(float64(restarts.Load())/float64(b.N), "restarts/op")
+			})
+		}
+	}
+}
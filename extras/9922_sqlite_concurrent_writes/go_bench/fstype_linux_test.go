@@ -0,0 +1,40 @@
+//go:build linux
+
+package sqlite_bench
+
+import "syscall"
+
+// filesystemTypes maps statfs magic numbers to names.
+// See statfs(2) and linux/magic.h.
+var filesystemTypes = map[int64]struct {
+	name    string
+	network bool
+}{
+	0xEF53:     {"ext4", false},
+	0x58465342: {"xfs", false},
+	0x9123683E: {"btrfs", false},
+	0x01021994: {"tmpfs", false},
+	0x794C7630: {"overlayfs", false},
+	0x2FC12FC1: {"zfs", false},
+	0x6969:     {"nfs", true},
+	0x517B:     {"smb", true},
+	0xFF534D42: {"cifs", true},
+	0xFE534D42: {"smb2", true},
+	0x01021997: {"9p", true},
+	0x00C36400: {"ceph", true},
+	0x65735546: {"fuse", true},
+}
+
+// filesystemType reports the filesystem type of dir and whether it's a
+// network filesystem, where SQLite's POSIX locks may not work reliably.
+// FUSE is treated as network since sshfs and most cloud mounts are FUSE.
+func filesystemType(dir string) (name string, network bool, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return "", false, err
+	}
+	if fs, ok := filesystemTypes[int64(st.Type)]; ok {
+		return fs.name, fs.network, nil
+	}
+	return "unknown", false, nil
+}
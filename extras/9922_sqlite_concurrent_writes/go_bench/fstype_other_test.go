@@ -0,0 +1,7 @@
+//go:build !linux
+
+package sqlite_bench
+
+func filesystemType(dir string) (name string, network bool, err error) {
+	return "unknown", false, nil
+}
@@ -0,0 +1,67 @@
+package sqlite_bench
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkWriteOnUserPath runs concurrent writers on a database in
+// SQLITE_BENCH_DIR, e.g. an NFS mount, and reports the locked error rate.
+// SQLite relies on POSIX advisory locks, which some network filesystems
+// implement incorrectly or not at all, so this can show lost locking
+// rather than just slowness. Skipped if SQLITE_BENCH_DIR is not set.
+// Should be used with -cpu=1.
+func BenchmarkWriteOnUserPath(b *testing.B) {
+	dir := os.Getenv("SQLITE_BENCH_DIR")
+	if dir == "" {
+		b.Skip("SQLITE_BENCH_DIR is not set")
+	}
+	fs, network, err := filesystemType(dir)
+	noErr(b, err)
+	b.Logf("%s is on %s", dir, fs)
+	if network {
+		b.Logf("WARNING: %s is a network filesystem, SQLite locking may be unreliable there", fs)
+	}
+	for _, journal := range []string{"DELETE", "WAL"} {
+		for _, concurrency := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("fs=%s&journal=%s&concurrency=%d", fs, journal, concurrency), func(b *testing.B) {
+				dbDir, err := os.MkdirTemp(dir, "sqlite_bench")
+				noErr(b, err)
+				defer os.RemoveAll(dbDir)
+				options := fmt.Sprintf("?_journal=%s&_timeout=5000&_fk=true&_synchronous=normal", journal)
+				db := makeDBAt(b, path.Join(dbDir, "benchmark.db"), options)
+				defer db.Close()
+				content := strings.Repeat("A", 1000)
+				var locked atomic.Int64
+				b.SetParallelism(concurrency)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						err := writeBlogPost(db, content)
+						if isBusy(err) {
+							locked.Add(1)
+						} else {
+							noErr(b, err)
+						}
+					}
+				})
+				b.ReportMetric(float64(locked.Load())/float64(b.N), "locked-errors/op")
+			})
+		}
+	}
+}
+
+func TestFilesystemType(t *testing.T) {
+	fs, network, err := filesystemType(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs == "" {
+		t.Fatal("empty filesystem type")
+	}
+	t.Logf("temp dir is on %s (network=%t)", fs, network)
+}
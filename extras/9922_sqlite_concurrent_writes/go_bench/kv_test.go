@@ -0,0 +1,431 @@
+package sqlite_bench
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// KVStore is a key-value store in a WITHOUT ROWID table, so a lookup by key
+// is a single b-tree search instead of an index search followed by a rowid
+// search. Statements are prepared once.
+//
+// Keys set with SetTTL expire: Get treats an expired key as missing and
+// deletes it, and a sweeper started with StartSweeper deletes expired keys
+// that are never read again. expires_at is in unix milliseconds, and NULL
+// for keys that don't expire.
+type KVStore struct {
+	db     *sql.DB
+	get    *sql.Stmt
+	set    *sql.Stmt
+	delete *sql.Stmt
+	expire *sql.Stmt
+
+	done   chan struct{}
+	wg     sync.WaitGroup
+	err    error
+	sweeps latencies
+	swept  int64
+}
+
+// NewKVStore opens or creates the store at path.
+func NewKVStore(path string) (*KVStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal=WAL&_timeout=5000&_synchronous=normal")
+	if err != nil {
+		return nil, err
+	}
+	s := &KVStore{db: db}
+	if err := s.init(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *KVStore) init() error {
+	_, err := s.db.Exec(`
+		create table if not exists kv (
+			key text primary key,
+			value blob not null,
+			expires_at integer
+		) without rowid;
+		create index if not exists kv_expires_at on kv (expires_at) where expires_at is not null`)
+	if err != nil {
+		return err
+	}
+	if s.get, err = s.db.Prepare(`select value, expires_at from kv where key = ?`); err != nil {
+		return err
+	}
+	if s.set, err = s.db.Prepare(`
+		insert into kv (key, value, expires_at) values (?, ?, ?)
+		on conflict (key) do update set value = excluded.value, expires_at = excluded.expires_at`); err != nil {
+		return err
+	}
+	if s.delete, err = s.db.Prepare(`delete from kv where key = ?`); err != nil {
+		return err
+	}
+	// The expires_at condition keeps a concurrent Set of a new value from
+	// being deleted.
+	s.expire, err = s.db.Prepare(`delete from kv where key = ? and expires_at <= ?`)
+	return err
+}
+
+// Get returns the value of key and whether it exists and hasn't expired.
+func (s *KVStore) Get(key string) ([]byte, bool, error) {
+	var value []byte
+	var expiresAt sql.NullInt64
+	err := s.get.QueryRow(key).Scan(&value, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if now := time.Now().UnixMilli(); expiresAt.Valid && expiresAt.Int64 <= now {
+		_, err := s.expire.Exec(key, now)
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *KVStore) Set(key string, value []byte) error {
+	_, err := s.set.Exec(key, value, nil)
+	return err
+}
+
+// SetTTL sets key to value until ttl from now.
+func (s *KVStore) SetTTL(key string, value []byte, ttl time.Duration) error {
+	_, err := s.set.Exec(key, value, time.Now().Add(ttl).UnixMilli())
+	return err
+}
+
+// SetMany sets all keys to their values in one transaction.
+func (s *KVStore) SetMany(kvs map[string][]byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	set := tx.Stmt(s.set)
+	for k, v := range kvs {
+		if _, err := set.Exec(k, v, nil); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *KVStore) Delete(key string) error {
+	_, err := s.delete.Exec(key)
+	return err
+}
+
+// StartSweeper deletes expired keys every interval until Close, at most
+// batch keys per transaction so that writers don't wait for a long delete.
+func (s *KVStore) StartSweeper(interval time.Duration, batch int) {
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			if err := s.sweep(batch); err != nil {
+				s.err = err
+				return
+			}
+		}
+	}()
+}
+
+// sweep deletes expired keys in batches until there are none left.
+func (s *KVStore) sweep(batch int) error {
+	for {
+		start := time.Now()
+		res, err := s.db.Exec(`
+			delete from kv where key in (
+				select key from kv where expires_at <= ? limit ?
+			)`, start.UnixMilli(), batch)
+		if err != nil {
+			return err
+		}
+		s.sweeps = append(s.sweeps, time.Since(start))
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		s.swept += n
+		if n < int64(batch) {
+			return nil
+		}
+	}
+}
+
+func (s *KVStore) Close() error {
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+	}
+	for _, stmt := range []*sql.Stmt{s.get, s.set, s.delete, s.expire} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return s.err
+}
+
+func kvKey(i int) string {
+	return fmt.Sprintf("key:%08d", i)
+}
+
+func TestKVStore(t *testing.T) {
+	s, err := NewKVStore(path.Join(t.TempDir(), "kv.db"))
+	noErr(t, err)
+	defer s.Close()
+	if _, ok, err := s.Get("missing"); err != nil || ok {
+		t.Fatalf("Get of a missing key: ok %t, err %v", ok, err)
+	}
+	noErr(t, s.Set("a", []byte("1")))
+	noErr(t, s.Set("a", []byte("2")))
+	noErr(t, s.SetMany(map[string][]byte{"b": []byte("3"), "c": []byte("4")}))
+	for key, want := range map[string]string{"a": "2", "b": "3", "c": "4"} {
+		if value, ok, err := s.Get(key); err != nil || !ok || !bytes.Equal(value, []byte(want)) {
+			t.Errorf("Get(%q) = %q, %t, %v, want %q", key, value, ok, err, want)
+		}
+	}
+	noErr(t, s.Delete("a"))
+	if _, ok, err := s.Get("a"); err != nil || ok {
+		t.Errorf("Get of a deleted key: ok %t, err %v", ok, err)
+	}
+}
+
+// BenchmarkKVStore compares KVStore operations on a store of 100000 keys
+// with the same statements run unprepared on a rowid table with a text
+// primary key, as a plain db.Exec implementation would.
+func BenchmarkKVStore(b *testing.B) {
+	const keys = 100000
+	value := bytes.Repeat([]byte("A"), 100)
+	for _, impl := range []string{"kvstore", "raw"} {
+		var s *KVStore
+		var db *sql.DB
+		setup := func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "kv.db")
+			var err error
+			if impl == "kvstore" {
+				s, err = NewKVStore(dbPath)
+				noErr(b, err)
+				db = s.db
+			} else {
+				db, err = sql.Open("sqlite3", dbPath+"?_journal=WAL&_timeout=5000&_synchronous=normal")
+				noErr(b, err)
+				_, err = db.Exec(`create table kv (key text primary key, value blob not null)`)
+				noErr(b, err)
+			}
+			tx, err := db.Begin()
+			noErr(b, err)
+			for i := 0; i < keys; i++ {
+				_, err := tx.Exec(`insert into kv (key, value) values (?, ?)`, kvKey(i), value)
+				noErr(b, err)
+			}
+			noErr(b, tx.Commit())
+		}
+		ops := map[string]func(i int) error{
+			"get": func(i int) error {
+				if impl == "kvstore" {
+					_, _, err := s.Get(kvKey(i % keys))
+					return err
+				}
+				var v []byte
+				return db.QueryRow(`select value from kv where key = ?`, kvKey(i%keys)).Scan(&v)
+			},
+			"set": func(i int) error {
+				if impl == "kvstore" {
+					return s.Set(kvKey(i%keys), value)
+				}
+				_, err := db.Exec(`insert into kv (key, value) values (?, ?) on conflict (key) do update set value = excluded.value`, kvKey(i%keys), value)
+				return err
+			},
+			"set-many": func(i int) error {
+				kvs := make(map[string][]byte, 100)
+				for j := 0; j < 100; j++ {
+					kvs[kvKey((i*100+j)%keys)] = value
+				}
+				return s.SetMany(kvs)
+			},
+		}
+		for _, op := range []string{"get", "set", "set-many"} {
+			if impl == "raw" && op == "set-many" {
+				continue
+			}
+			b.Run(fmt.Sprintf("impl=%s&op=%s", impl, op), func(b *testing.B) {
+				setup(b)
+				if impl == "kvstore" {
+					defer s.Close()
+				} else {
+					defer db.Close()
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					noErr(b, ops[op](i))
+				}
+				b.StopTimer()
+				n := b.N
+				if op == "set-many" {
+					n *= 100
+				}
+				b.ReportMetric(float64(n)/b.Elapsed().Seconds(), "keys/s")
+			})
+		}
+	}
+}
+
+func TestKVStoreTTL(t *testing.T) {
+	s, err := NewKVStore(path.Join(t.TempDir(), "kv.db"))
+	noErr(t, err)
+	defer s.Close()
+	noErr(t, s.SetTTL("read", []byte("1"), time.Millisecond))
+	noErr(t, s.SetTTL("unread", []byte("2"), time.Millisecond))
+	noErr(t, s.SetTTL("later", []byte("3"), time.Hour))
+	time.Sleep(5 * time.Millisecond)
+	if _, ok, err := s.Get("read"); err != nil || ok {
+		t.Errorf("Get of an expired key: ok %t, err %v", ok, err)
+	}
+	if _, ok, err := s.Get("later"); err != nil || !ok {
+		t.Errorf("Get of a key that hasn't expired: ok %t, err %v", ok, err)
+	}
+	var count int
+	noErr(t, s.db.QueryRow(`select count(*) from kv`).Scan(&count))
+	if count != 2 {
+		t.Errorf("got %d keys after reading an expired one, want 2", count)
+	}
+	noErr(t, s.sweep(1))
+	noErr(t, s.db.QueryRow(`select count(*) from kv`).Scan(&count))
+	if count != 1 || s.swept != 1 {
+		t.Errorf("got %d keys after sweeping %d, want 1 after sweeping 1", count, s.swept)
+	}
+}
+
+// BenchmarkKVStoreTTL alternates sets and gets of random keys out of 100000.
+// With ttl=none keys don't expire. Otherwise every set has a 100ms TTL, so
+// most keys have expired by the time they're read again, and with
+// sweeper=true a sweeper deletes them every 100ms in batches of 1000.
+// sweep-max-ns is the longest a sweep batch held the write lock.
+func BenchmarkKVStoreTTL(b *testing.B) {
+	const keys = 100000
+	value := bytes.Repeat([]byte("A"), 100)
+	for _, mode := range []struct {
+		ttl     time.Duration
+		sweeper bool
+	}{{0, false}, {100 * time.Millisecond, false}, {100 * time.Millisecond, true}} {
+		ttl := "none"
+		if mode.ttl != 0 {
+			ttl = mode.ttl.String()
+		}
+		b.Run(fmt.Sprintf("ttl=%s&sweeper=%t", ttl, mode.sweeper), func(b *testing.B) {
+			s, err := NewKVStore(path.Join(b.TempDir(), "kv.db"))
+			noErr(b, err)
+			if mode.sweeper {
+				s.StartSweeper(100*time.Millisecond, 1000)
+			}
+			var gets, hits int
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := kvKey(rand.IntN(keys))
+				if i%2 == 0 {
+					if mode.ttl == 0 {
+						noErr(b, s.Set(key, value))
+					} else {
+						noErr(b, s.SetTTL(key, value, mode.ttl))
+					}
+					continue
+				}
+				_, ok, err := s.Get(key)
+				noErr(b, err)
+				gets++
+				if ok {
+					hits++
+				}
+			}
+			b.StopTimer()
+			var count int
+			noErr(b, s.db.QueryRow(`select count(*) from kv`).Scan(&count))
+			noErr(b, s.Close())
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+			if gets > 0 {
+				b.ReportMetric(float64(hits)/float64(gets), "hit-rate")
+			}
+			b.ReportMetric(float64(count), "keys")
+			if mode.sweeper {
+				b.ReportMetric(float64(s.swept), "swept")
+				b.ReportMetric(float64(slices.Max(append(s.sweeps, 0)).Nanoseconds()), "sweep-max-ns")
+			}
+		})
+	}
+}
+
+// BenchmarkKVKeyType inserts b.N keys into a KV table in transactions of
+// 1000. keys=integer uses an integer primary key, which is the rowid, in
+// increasing order, so every insert appends to the rightmost leaf page.
+// keys=text-sequential uses zero-padded text keys in the same order in a
+// WITHOUT ROWID table like KVStore's. keys=text-random uses random hex keys,
+// as hashes or UUIDs would be, which insert all over the b-tree, so a
+// transaction dirties a different page for almost every key. SQLite's
+// balancing keeps the pages nearly as full as with sequential keys, though.
+// bytes/key is the database size after a checkpoint divided by the number
+// of keys.
+func BenchmarkKVKeyType(b *testing.B) {
+	value := bytes.Repeat([]byte("A"), 100)
+	for _, keys := range []string{"integer", "text-sequential", "text-random"} {
+		b.Run(fmt.Sprintf("keys=%s", keys), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "kv.db")
+			db, err := sql.Open("sqlite3", dbPath+"?_journal=WAL&_timeout=5000&_synchronous=normal")
+			noErr(b, err)
+			defer db.Close()
+			db.SetMaxOpenConns(1)
+			schema := `create table kv (key text primary key, value blob not null) without rowid`
+			if keys == "integer" {
+				schema = `create table kv (key integer primary key, value blob not null)`
+			}
+			_, err = db.Exec(schema)
+			noErr(b, err)
+			key := func(i int) any {
+				switch keys {
+				case "integer":
+					return i
+				case "text-sequential":
+					return kvKey(i)
+				}
+				return fmt.Sprintf("%016x", rand.Uint64())
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i += 1000 {
+				tx, err := db.Begin()
+				noErr(b, err)
+				for j := i; j < min(i+1000, b.N); j++ {
+					_, err := tx.Exec(`insert into kv (key, value) values (?, ?)`, key(j), value)
+					noErr(b, err)
+				}
+				noErr(b, tx.Commit())
+			}
+			b.StopTimer()
+			_, err = db.Exec(`pragma wal_checkpoint(TRUNCATE)`)
+			noErr(b, err)
+			b.ReportMetric(float64(fileSize(dbPath))/float64(b.N), "bytes/key")
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"path"
+	"testing"
+	"time"
+
+	"sqlite_bench/sqliteext"
+)
+
+func TestLatencyVFS(t *testing.T) {
+	if err := sqliteext.RegisterLatencyVFS(); err != nil {
+		t.Fatal(err)
+	}
+	for _, journal := range []string{"DELETE", "WAL"} {
+		t.Run(journal, func(t *testing.T) {
+			db, err := sql.Open("sqlite3", path.Join(t.TempDir(), "test.db")+"?vfs=latency&_journal="+journal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := setupDB(db); err != nil {
+				t.Fatal(err)
+			}
+			if err := writeBlogPost(db, "A"); err != nil {
+				t.Fatal(err)
+			}
+
+			sqliteext.SetVFSLatency(10 * time.Millisecond)
+			defer sqliteext.SetVFSLatency(0)
+			start := time.Now()
+			if err := writeBlogPost(db, "B"); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+				t.Errorf("write took %s, want at least the injected 10ms", elapsed)
+			}
+			content, err := readBlogPostByID(db, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content != "B" {
+				t.Errorf("got %q, want %q", content, "B")
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+)
+
+// setupLog creates a logs table. With mode=trigger, a trigger deletes the
+// row that falls out of the last limit rows on every insert. Ids are
+// assigned by SQLite and never reused while rows are only deleted from the
+// start, so the last limit rows are the ones with id > max(id) - limit.
+func setupLog(db *sql.DB, mode string, limit int) error {
+	_, err := db.Exec(`
+		create table logs (
+			id integer primary key,
+			message text not null
+		)`)
+	if err != nil || mode != "trigger" {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`
+		create trigger logs_cap after insert on logs begin
+			delete from logs where id <= new.id - %d;
+		end`, limit))
+	return err
+}
+
+// appendLog inserts message. With mode=delete, it deletes the oldest rows
+// past limit in the same transaction, and with mode=trim, it does that only
+// every trimEvery inserts, so the table grows up to limit+trimEvery rows.
+func appendLog(db *sql.DB, mode string, limit, trimEvery int, message string) error {
+	if mode != "delete" {
+		res, err := db.Exec(`insert into logs (message) values (?)`, message)
+		if err != nil || mode != "trim" {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil || id%int64(trimEvery) != 0 {
+			return err
+		}
+		_, err = db.Exec(`delete from logs where id <= ?`, id-int64(limit))
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`insert into logs (message) values (?)`, message)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`delete from logs where id <= ?`, id-int64(limit)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func TestCappedLog(t *testing.T) {
+	for _, mode := range []string{"delete", "trigger", "trim"} {
+		t.Run(mode, func(t *testing.T) {
+			db := makeDB(t, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			defer db.Close()
+			noErr(t, setupLog(db, mode, 10))
+			for i := 0; i < 100; i++ {
+				noErr(t, appendLog(db, mode, 10, 5, "A"))
+			}
+			var count, minID int
+			noErr(t, db.QueryRow(`select count(*), min(id) from logs`).Scan(&count, &minID))
+			if count != 10 || minID != 91 {
+				t.Errorf("got %d rows starting at id %d, want 10 starting at 91", count, minID)
+			}
+		})
+	}
+}
+
+// BenchmarkCappedLog appends messages to a log capped at 10000 rows that
+// starts out full. mode=delete deletes the oldest row in the insert's
+// transaction, mode=trigger does the same in a trigger, and mode=trim lets
+// the log grow and deletes the overflow every 1000 inserts. mode=unbounded
+// never deletes. Deleted pages go on the freelist and are reused, so
+// db-bytes, the size of the database after the run, stops growing for the
+// capped modes.
+func BenchmarkCappedLog(b *testing.B) {
+	const limit = 10000
+	message := strings.Repeat("A", 200)
+	for _, mode := range []string{"unbounded", "delete", "trigger", "trim"} {
+		b.Run(fmt.Sprintf("mode=%s", mode), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			db, err := sql.Open("sqlite3", dbPath+"?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			noErr(b, err)
+			defer db.Close()
+			noErr(b, setupLog(db, mode, limit))
+			noErr(b, insertSeries(db, `insert into logs (message) select ? from series`, limit, message))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				noErr(b, appendLog(db, mode, limit, 1000, message))
+			}
+			b.StopTimer()
+			var pageCount, pageSize, rows int
+			noErr(b, db.QueryRow(`pragma page_count`).Scan(&pageCount))
+			noErr(b, db.QueryRow(`pragma page_size`).Scan(&pageSize))
+			noErr(b, db.QueryRow(`select count(*) from logs`).Scan(&rows))
+			b.ReportMetric(float64(pageCount*pageSize), "db-bytes")
+			b.ReportMetric(float64(rows), "rows")
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package sqlite_bench
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// MergingWriterSet gives every writer its own SQLite file, so writers never
+// wait for each other's locks, and periodically merges the writers' posts
+// into the main database. A merge ATTACHes all writer files to a main
+// connection and copies the rows past each writer's watermark with
+// INSERT ... SELECT. The watermarks are kept in the main database and
+// updated in the same transaction, so a crash doesn't merge a row twice.
+// SQLite allows 10 attached databases by default.
+type MergingWriterSet struct {
+	main    *sql.DB
+	writers []*sql.DB
+	paths   []string
+	done    chan struct{}
+	wg      sync.WaitGroup
+	err     error
+
+	merges    int
+	merged    int64
+	mergeTime time.Duration
+}
+
+// NewMergingWriterSet creates dir/main.db and n writer files in dir and
+// merges every interval until Close.
+func NewMergingWriterSet(dir string, n int, interval time.Duration) (*MergingWriterSet, error) {
+	options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+	main, err := sql.Open("sqlite3", path.Join(dir, "main.db")+options)
+	if err != nil {
+		return nil, err
+	}
+	s := &MergingWriterSet{main: main, done: make(chan struct{})}
+	if err := setupDB(main); err != nil {
+		s.closeDBs()
+		return nil, err
+	}
+	if _, err := main.Exec(`create table merge_state (writer integer primary key, last_id integer not null)`); err != nil {
+		s.closeDBs()
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		p := path.Join(dir, fmt.Sprintf("writer-%d.db", i))
+		db, err := sql.Open("sqlite3", p+options)
+		if err == nil {
+			s.writers = append(s.writers, db)
+			s.paths = append(s.paths, p)
+			err = setupDB(db)
+		}
+		if err == nil {
+			_, err = main.Exec(`insert into merge_state (writer, last_id) values (?, 0)`, i)
+		}
+		if err != nil {
+			s.closeDBs()
+			return nil, err
+		}
+	}
+	s.wg.Add(1)
+	go s.run(interval)
+	return s, nil
+}
+
+// Write inserts a post into the file of writer i.
+func (s *MergingWriterSet) Write(i int, content string) error {
+	return writeBlogPost(s.writers[i], content)
+}
+
+func (s *MergingWriterSet) run(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if err := s.Merge(); err != nil {
+			s.err = err
+			return
+		}
+	}
+}
+
+// Merge copies the posts written since the last merge into the main
+// database. It must not be called concurrently.
+func (s *MergingWriterSet) Merge() error {
+	start := time.Now()
+	ctx := context.Background()
+	conn, err := s.main.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for i, p := range s.paths {
+		if _, err := conn.ExecContext(ctx, `attach database ? as ?`, p, fmt.Sprintf("w%d", i)); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `detach database ?`, fmt.Sprintf("w%d", i))
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var merged int64
+	for i := range s.paths {
+		// Reads from an attached database share the transaction's snapshot,
+		// so max(id) below covers exactly the rows copied here.
+		res, err := tx.Exec(fmt.Sprintf(`
+			insert into main.posts (content)
+			select content from w%d.posts
+			where id > (select last_id from merge_state where writer = ?1)
+			order by id`, i), i)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		merged += n
+		_, err = tx.Exec(fmt.Sprintf(`
+			update merge_state set last_id = (select coalesce(max(id), last_id) from w%d.posts)
+			where writer = ?1`, i), i)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.merges++
+	s.merged += merged
+	s.mergeTime += time.Since(start)
+	return nil
+}
+
+// Close stops the background merges, merges the remaining posts and closes
+// all databases.
+func (s *MergingWriterSet) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	err := s.err
+	if err == nil {
+		err = s.Merge()
+	}
+	if closeErr := s.closeDBs(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *MergingWriterSet) closeDBs() error {
+	err := s.main.Close()
+	for _, db := range s.writers {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// BenchmarkMergingWriterSet compares concurrent writers sharing one
+// database file with writers that each write to their own file in a
+// MergingWriterSet. rows/s counts writes until all rows are in the main
+// database, including the final merge. Should be used with -cpu=1.
+func BenchmarkMergingWriterSet(b *testing.B) {
+	for _, writers := range []int{4, 8} {
+		for _, interval := range []time.Duration{0, 10 * time.Millisecond, 100 * time.Millisecond, time.Second} {
+			name := interval.String()
+			if interval == 0 {
+				name = "single-file"
+			}
+			b.Run(fmt.Sprintf("writers=%d&merge_interval=%s", writers, name), func(b *testing.B) {
+				content := strings.Repeat("A", 1000)
+				var write func(i int, content string) error
+				var set *MergingWriterSet
+				if interval == 0 {
+					db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+					write = func(_ int, content string) error { return writeBlogPost(db, content) }
+				} else {
+					var err error
+					set, err = NewMergingWriterSet(b.TempDir(), writers, interval)
+					noErr(b, err)
+					write = set.Write
+				}
+				var next atomic.Int64
+				b.SetParallelism(writers)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := int(next.Add(1)-1) % writers
+					for pb.Next() {
+						noErr(b, write(i, content))
+					}
+				})
+				if set != nil {
+					noErr(b, set.Close())
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+				if set != nil {
+					if set.merged != int64(b.N) {
+						b.Fatalf("merged %d rows, want %d", set.merged, b.N)
+					}
+					b.ReportMetric(float64(set.merges), "merges")
+					b.ReportMetric(float64(set.mergeTime.Nanoseconds())/float64(set.merges), "merge-ns")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package sqlite_bench
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// execer is the smallest interface a data-access wrapper would sit behind.
+type execer interface {
+	exec(ctx context.Context, content string) error
+}
+
+type nopExecer struct{}
+
+//go:noinline
+func (nopExecer) exec(ctx context.Context, content string) error {
+	return nil
+}
+
+//go:noinline
+func nopExec(ctx context.Context, content string) error {
+	return nil
+}
+
+// wrapEmpty is an empty wrapper layer: it takes a closure like a retry or
+// tracing helper would and calls it exactly once.
+//
+//go:noinline
+func wrapEmpty(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// BenchmarkWrapperOverhead measures wrapper layers around a no-op instead of a
+// query, so the numbers are the instrumentation cost alone.
+func BenchmarkWrapperOverhead(b *testing.B) {
+	ctx := context.Background()
+	content := "A"
+
+	b.Run("layers=direct", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			noErr(b, nopExec(ctx, content))
+		}
+	})
+	b.Run("layers=interface", func(b *testing.B) {
+		var e execer = nopExecer{}
+		for i := 0; i < b.N; i++ {
+			noErr(b, e.exec(ctx, content))
+		}
+	})
+	b.Run("layers=closure", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := wrapEmpty(ctx, func(ctx context.Context) error {
+				return nopExec(ctx, content)
+			})
+			noErr(b, err)
+		}
+	})
+	b.Run("layers=context+closure+interface", func(b *testing.B) {
+		var e execer = nopExecer{}
+		for i := 0; i < b.N; i++ {
+			ctx, cancel := context.WithCancel(ctx)
+			err := wrapEmpty(ctx, func(ctx context.Context) error {
+				return wrapEmpty(ctx, func(ctx context.Context) error {
+					return e.exec(ctx, content)
+				})
+			})
+			cancel()
+			noErr(b, err)
+		}
+	})
+}
+
+// LoggingDB logs queries that take longer than threshold.
+// Query and QueryRow are timed until the statement returns, so the time
+// spent iterating over rows isn't included.
+type LoggingDB struct {
+	*sql.DB
+	threshold time.Duration
+	logger    *log.Logger
+}
+
+func NewLoggingDB(db *sql.DB, threshold time.Duration, logger *log.Logger) *LoggingDB {
+	return &LoggingDB{DB: db, threshold: threshold, logger: logger}
+}
+
+func (l *LoggingDB) Exec(query string, args ...any) (sql.Result, error) {
+	start := time.Now()
+	res, err := l.DB.Exec(query, args...)
+	l.logSlow(start, query)
+	return res, err
+}
+
+func (l *LoggingDB) Query(query string, args ...any) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := l.DB.Query(query, args...)
+	l.logSlow(start, query)
+	return rows, err
+}
+
+func (l *LoggingDB) QueryRow(query string, args ...any) *sql.Row {
+	start := time.Now()
+	row := l.DB.QueryRow(query, args...)
+	l.logSlow(start, query)
+	return row
+}
+
+func (l *LoggingDB) logSlow(start time.Time, query string) {
+	if elapsed := time.Since(start); elapsed > l.threshold {
+		l.logSlowQuery(elapsed, query)
+	}
+}
+
+// logSlowQuery is kept out of logSlow so that the fast path stays small
+// enough to inline.
+func (l *LoggingDB) logSlowQuery(elapsed time.Duration, query string) {
+	l.logger.Printf("slow query (%s): %s", elapsed, strings.Join(strings.Fields(query), " "))
+}
+
+// execQuerier is implemented by both *sql.DB and *LoggingDB.
+type execQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// BenchmarkLoggingDB compares raw database/sql with LoggingDB for writes and
+// point reads. threshold=1s never logs, threshold=0 logs every query to
+// io.Discard.
+func BenchmarkLoggingDB(b *testing.B) {
+	for _, workload := range []string{"write", "read"} {
+		for _, threshold := range []time.Duration{-1, time.Second, 0} {
+			name := threshold.String()
+			if threshold < 0 {
+				name = "raw"
+			}
+			b.Run(fmt.Sprintf("workload=%s&threshold=%s", workload, name), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				content := strings.Repeat("A", 1000)
+				noErr(b, insertRowsLoop(db, content, 1000))
+				var q execQuerier = db
+				if threshold >= 0 {
+					q = NewLoggingDB(db, threshold, log.New(io.Discard, "", log.LstdFlags))
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var err error
+					if workload == "write" {
+						_, err = q.Exec(`insert into posts (content) values (?)`, content)
+					} else {
+						var got string
+						err = q.QueryRow(`select content from posts where id = ?`, i%1000+1).Scan(&got)
+					}
+					noErr(b, err)
+				}
+			})
+		}
+	}
+}
+
+// QueryFunc runs a statement, like (*sql.DB).ExecContext.
+type QueryFunc func(ctx context.Context, query string, args ...any) (sql.Result, error)
+
+// QueryMiddleware wraps a QueryFunc with extra behaviour.
+type QueryMiddleware func(next QueryFunc) QueryFunc
+
+// Chain wraps f with middlewares, the first one being the outermost.
+func Chain(f QueryFunc, middlewares ...QueryMiddleware) QueryFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		f = middlewares[i](f)
+	}
+	return f
+}
+
+// RetryMiddleware retries a statement that failed with SQLITE_BUSY or
+// SQLITE_LOCKED up to attempts times in total, sleeping backoff, 2*backoff,
+// and so on between attempts.
+func RetryMiddleware(attempts int, backoff time.Duration) QueryMiddleware {
+	return func(next QueryFunc) QueryFunc {
+		return func(ctx context.Context, query string, args ...any) (sql.Result, error) {
+			delay := backoff
+			for attempt := 1; ; attempt++ {
+				res, err := next(ctx, query, args...)
+				if _, _, retryable := describeError(err); !retryable || attempt == attempts {
+					return res, err
+				}
+				select {
+				case <-ctx.Done():
+					return res, err
+				case <-time.After(delay):
+				}
+				delay *= 2
+			}
+		}
+	}
+}
+
+// Span is a trace span of one statement.
+type Span struct {
+	Query      string
+	Start, End time.Time
+	Err        error
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span TracingMiddleware put into ctx.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// TracingMiddleware starts a span for every statement, makes it available
+// to inner layers through the context and passes it to export when the
+// statement returns.
+func TracingMiddleware(export func(*Span)) QueryMiddleware {
+	return func(next QueryFunc) QueryFunc {
+		return func(ctx context.Context, query string, args ...any) (sql.Result, error) {
+			span := &Span{Query: query, Start: time.Now()}
+			res, err := next(context.WithValue(ctx, spanKey{}, span), query, args...)
+			span.End, span.Err = time.Now(), err
+			export(span)
+			return res, err
+		}
+	}
+}
+
+// QueryMetrics counts statements and errors and keeps a histogram of
+// statement durations with power-of-two microsecond buckets.
+type QueryMetrics struct {
+	Count, Errors atomic.Int64
+	Buckets       [24]atomic.Int64
+}
+
+// MetricsMiddleware records every statement in m.
+func MetricsMiddleware(m *QueryMetrics) QueryMiddleware {
+	return func(next QueryFunc) QueryFunc {
+		return func(ctx context.Context, query string, args ...any) (sql.Result, error) {
+			start := time.Now()
+			res, err := next(ctx, query, args...)
+			us := uint64(time.Since(start).Microseconds())
+			m.Buckets[min(bits.Len64(us), len(m.Buckets)-1)].Add(1)
+			m.Count.Add(1)
+			if err != nil {
+				m.Errors.Add(1)
+			}
+			return res, err
+		}
+	}
+}
+
+// BenchmarkQueryMiddleware measures a retry, tracing and metrics middleware
+// stack, each layer on its own and all three together. target=write inserts
+// posts, target=nop calls a QueryFunc that does nothing, which gives the cost
+// of the layers alone. overhead-ns is ns/op minus the ns/op of layers=raw
+// for the same target, so it is only meaningful if layers=raw ran too.
+func BenchmarkQueryMiddleware(b *testing.B) {
+	var spans []*Span
+	export := func(s *Span) {
+		if len(spans) == 1000 {
+			spans = spans[:0]
+		}
+		spans = append(spans, s)
+	}
+	stacks := []struct {
+		name        string
+		middlewares func(m *QueryMetrics) []QueryMiddleware
+	}{
+		{"raw", func(*QueryMetrics) []QueryMiddleware { return nil }},
+		{"retry", func(*QueryMetrics) []QueryMiddleware {
+			return []QueryMiddleware{RetryMiddleware(10, time.Millisecond)}
+		}},
+		{"tracing", func(*QueryMetrics) []QueryMiddleware {
+			return []QueryMiddleware{TracingMiddleware(export)}
+		}},
+		{"metrics", func(m *QueryMetrics) []QueryMiddleware {
+			return []QueryMiddleware{MetricsMiddleware(m)}
+		}},
+		{"all", func(m *QueryMetrics) []QueryMiddleware {
+			return []QueryMiddleware{MetricsMiddleware(m), TracingMiddleware(export), RetryMiddleware(10, time.Millisecond)}
+		}},
+	}
+	for _, target := range []string{"nop", "write"} {
+		var rawNs float64
+		for _, stack := range stacks {
+			b.Run(fmt.Sprintf("target=%s&layers=%s", target, stack.name), func(b *testing.B) {
+				f := QueryFunc(func(ctx context.Context, query string, args ...any) (sql.Result, error) {
+					return nil, nil
+				})
+				if target == "write" {
+					db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+					f = db.ExecContext
+				}
+				var m QueryMetrics
+				f = Chain(f, stack.middlewares(&m)...)
+				ctx := context.Background()
+				content := strings.Repeat("A", 1000)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_, err := f(ctx, `insert into posts (content) values (?)`, content)
+					noErr(b, err)
+				}
+				b.StopTimer()
+				ns := float64(b.Elapsed().Nanoseconds()) / float64(b.N)
+				if stack.name == "raw" {
+					rawNs = ns
+				}
+				b.ReportMetric(ns-rawNs, "overhead-ns")
+			})
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func setupChanges(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table changes (
+			id integer primary key,
+			created_at integer not null
+		)`)
+	return err
+}
+
+// produceChanges inserts n changes at rate changes per second, recording the
+// insert time in each row.
+func produceChanges(db *sql.DB, n int, rate int) error {
+	interval := time.Second / time.Duration(rate)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if d := time.Until(start.Add(time.Duration(i) * interval)); d > 0 {
+			time.Sleep(d)
+		}
+		if _, err := db.Exec(`insert into changes (created_at) values (?)`, time.Now().UnixNano()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pollChanges returns the changes after lastID and the notification latency
+// of each of them.
+func pollChanges(db *sql.DB, lastID int64) (int64, latencies, error) {
+	rows, err := db.Query(`select id, created_at from changes where id > ? order by id`, lastID)
+	if err != nil {
+		return lastID, nil, err
+	}
+	defer rows.Close()
+	now := time.Now()
+	var lats latencies
+	for rows.Next() {
+		var createdAt int64
+		if err := rows.Scan(&lastID, &createdAt); err != nil {
+			return lastID, nil, err
+		}
+		lats = append(lats, now.Sub(time.Unix(0, createdAt)))
+	}
+	return lastID, lats, rows.Err()
+}
+
+// BenchmarkPollChanges models change notification by polling a changes table
+// with an increasing id. One op is one change produced at the given rate.
+// Reports the notification latency and the cost of polling.
+func BenchmarkPollChanges(b *testing.B) {
+	for _, rate := range []int{100, 1000} {
+		for _, interval := range []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond} {
+			b.Run(fmt.Sprintf("rate=%d/s&poll_interval=%s", rate, interval), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				noErr(b, setupChanges(db))
+				var lats latencies
+				var polls, emptyPolls int
+				var pollTime time.Duration
+				done := make(chan struct{})
+				var wg sync.WaitGroup
+				wg.Add(1)
+				b.ResetTimer()
+				go func() {
+					defer wg.Done()
+					ticker := time.NewTicker(interval)
+					defer ticker.Stop()
+					lastID := int64(0)
+					for lastID < int64(b.N) {
+						select {
+						case <-done:
+							return
+						case <-ticker.C:
+						}
+						t := time.Now()
+						var l latencies
+						var err error
+						lastID, l, err = pollChanges(db, lastID)
+						pollTime += time.Since(t)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						polls++
+						if len(l) == 0 {
+							emptyPolls++
+						}
+						lats = append(lats, l...)
+					}
+				}()
+				if err := produceChanges(db, b.N, rate); err != nil {
+					close(done)
+					b.Fatal(err)
+				}
+				wg.Wait()
+				b.StopTimer()
+				reportLatencies(b, lats, "notify-")
+				b.ReportMetric(float64(pollTime.Nanoseconds())/float64(polls), "ns/poll")
+				b.ReportMetric(float64(emptyPolls)/float64(polls), "empty-poll-ratio")
+			})
+		}
+	}
+}
+
+// BenchmarkUpdateHookNotify delivers change notifications from an update hook
+// registered on every connection instead of polling. The hook runs inside
+// the insert, before the transaction commits, so a subscriber may be told
+// about a change that is later rolled back. One op is one insert.
+// mode=none is the same insert without a hook, to show the write overhead.
+func BenchmarkUpdateHookNotify(b *testing.B) {
+	for _, mode := range []string{"none", "hook"} {
+		b.Run(fmt.Sprintf("mode=%s", mode), func(b *testing.B) {
+			notifications := make(chan int64, 1024)
+			var hook func(*sqlite3.SQLiteConn) error
+			if mode == "hook" {
+				hook = func(conn *sqlite3.SQLiteConn) error {
+					conn.RegisterUpdateHook(func(op int, db string, table string, rowid int64) {
+						if op == sqlite3.SQLITE_INSERT && table == "changes" {
+							notifications <- rowid
+						}
+					})
+					return nil
+				}
+			}
+			dsn := path.Join(b.TempDir(), "benchmark.db") + "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			db := openWithHook(dsn, hook)
+			defer db.Close()
+			noErr(b, setupChanges(db))
+
+			insertedAt := make([]atomic.Int64, b.N+1)
+			lats := make(latencies, 0, b.N)
+			var wg sync.WaitGroup
+			if mode == "hook" {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for id := range notifications {
+						lats = append(lats, time.Since(time.Unix(0, insertedAt[id].Load())))
+					}
+				}()
+			}
+			b.ResetTimer()
+			for i := 1; i <= b.N; i++ {
+				now := time.Now().UnixNano()
+				insertedAt[i].Store(now)
+				_, err := db.Exec(`insert into changes (id, created_at) values (?, ?)`, i, now)
+				noErr(b, err)
+			}
+			b.StopTimer()
+			close(notifications)
+			wg.Wait()
+			if mode == "hook" {
+				if len(lats) != b.N {
+					b.Errorf("got %d notifications, want %d", len(lats), b.N)
+				}
+				reportLatencies(b, lats, "notify-")
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// setupCounters creates n counters with a version column that every update
+// increments.
+func setupCounters(db *sql.DB, n int) error {
+	_, err := db.Exec(`
+		create table counters (
+			id integer primary key,
+			value integer not null,
+			version integer not null
+		)`)
+	if err != nil {
+		return err
+	}
+	return insertSeries(db, `
+		insert into counters (id, value, version) select value, 0, 0 from series`, n)
+}
+
+// retryCAS runs update, a compare-and-swap on a version column, with the
+// arguments read returns, until it changes a row. read reads the row again
+// for every attempt, so the version in its arguments is current. It returns
+// the number of failed swaps.
+func retryCAS(db *sql.DB, update string, read func() ([]any, error)) (int, error) {
+	for failures := 0; ; failures++ {
+		args, err := read()
+		if err != nil {
+			return failures, err
+		}
+		res, err := db.Exec(update, args...)
+		if err != nil {
+			return failures, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 1 {
+			return failures, err
+		}
+	}
+}
+
+// incrementOptimistic reads a counter, and writes back the incremented value
+// only if the version is still the one it read, retrying otherwise. The read
+// and the write are separate autocommit statements, so nothing is locked in
+// between. It returns the number of retries.
+func incrementOptimistic(db *sql.DB, id int64) (int, error) {
+	return retryCAS(db, `
+		update counters set value = ?, version = version + 1
+		where id = ? and version = ?`, func() ([]any, error) {
+		var value, version int64
+		err := db.QueryRow(`select value, version from counters where id = ?`, id).Scan(&value, &version)
+		return []any{value + 1, id, version}, err
+	})
+}
+
+// incrementPessimistic does the same read-modify-write under mu.
+func incrementPessimistic(mu *sync.Mutex, db *sql.DB, id int64) error {
+	mu.Lock()
+	defer mu.Unlock()
+	var value int64
+	if err := db.QueryRow(`select value from counters where id = ?`, id).Scan(&value); err != nil {
+		return err
+	}
+	_, err := db.Exec(`update counters set value = ?, version = version + 1 where id = ?`, value+1, id)
+	return err
+}
+
+// BenchmarkOptimisticConcurrency increments a single hot counter from
+// concurrent goroutines with optimistic version checks or a mutex around
+// the read-modify-write. It fails if an increment got lost.
+// Should be used with -cpu=1.
+func BenchmarkOptimisticConcurrency(b *testing.B) {
+	for _, mode := range []string{"optimistic", "mutex"} {
+		for _, concurrency := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("mode=%s&concurrency=%d", mode, concurrency), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				noErr(b, setupCounters(db, 1))
+				var mu sync.Mutex
+				var retries atomic.Int64
+				b.SetParallelism(concurrency)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if mode == "mutex" {
+							noErr(b, incrementPessimistic(&mu, db, 1))
+							continue
+						}
+						n, err := incrementOptimistic(db, 1)
+						noErr(b, err)
+						retries.Add(int64(n))
+					}
+				})
+				b.StopTimer()
+				var value int
+				noErr(b, db.QueryRow(`select value from counters where id = 1`).Scan(&value))
+				if value != b.N {
+					b.Fatalf("counter is %d after %d increments", value, b.N)
+				}
+				b.ReportMetric(float64(retries.Load())/float64(b.N), "retries/op")
+				b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+			})
+		}
+	}
+}
+
+// TestSchemaVersionIgnoresDataChanges shows why PRAGMA schema_version can't
+// serve as a version for optimistic concurrency on data: it only changes
+// when the schema does.
+func TestSchemaVersionIgnoresDataChanges(t *testing.T) {
+	db := makeDB(t, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+	schemaVersion := func() int {
+		var v int
+		noErr(t, db.QueryRow(`pragma schema_version`).Scan(&v))
+		return v
+	}
+	before := schemaVersion()
+	noErr(t, writeBlogPost(db, "A"))
+	if after := schemaVersion(); after != before {
+		t.Errorf("schema_version changed from %d to %d on insert", before, after)
+	}
+	_, err := db.Exec(`create index posts_content on posts (content)`)
+	noErr(t, err)
+	if after := schemaVersion(); after == before {
+		t.Errorf("schema_version didn't change on create index")
+	}
+}
+
+// setupDocuments creates n documents with a version column.
+func setupDocuments(db *sql.DB, n int) error {
+	_, err := db.Exec(`
+		create table documents (
+			id integer primary key,
+			content text not null,
+			version integer not null default 0
+		)`)
+	if err != nil {
+		return err
+	}
+	return insertSeries(db, `
+		insert into documents (id, content) select value, '' from series`, n)
+}
+
+// casUpdate reads a document's version and replaces its content with a
+// compare-and-swap on the version, retrying until the swap succeeds. The
+// version can't be a generated column since it has to change on every
+// update, not be derived from the row. It returns the number of failed
+// swaps.
+func casUpdate(db *sql.DB, id int64, content string) (int, error) {
+	return retryCAS(db, `
+		update documents set content = ?, version = version + 1
+		where id = ? and version = ?`, func() ([]any, error) {
+		var version int64
+		err := db.QueryRow(`select version from documents where id = ?`, id).Scan(&version)
+		return []any{content, id, version}, err
+	})
+}
+
+// BenchmarkCASUpdate runs CAS updates of random documents out of a hot set
+// from concurrent goroutines and reports the share of swaps that failed
+// because another goroutine updated the document in between.
+// Should be used with -cpu=1.
+func BenchmarkCASUpdate(b *testing.B) {
+	for _, docs := range []int{1, 10, 1000} {
+		for _, concurrency := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("documents=%d&concurrency=%d", docs, concurrency), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				noErr(b, setupDocuments(db, docs))
+				content := strings.Repeat("A", 1000)
+				var failures atomic.Int64
+				b.SetParallelism(concurrency)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						n, err := casUpdate(db, rand.Int64N(int64(docs))+1, content)
+						noErr(b, err)
+						failures.Add(int64(n))
+					}
+				})
+				b.StopTimer()
+				var versions int
+				noErr(b, db.QueryRow(`select sum(version) from documents`).Scan(&versions))
+				if versions != b.N {
+					b.Fatalf("versions add up to %d after %d updates", versions, b.N)
+				}
+				f := float64(failures.Load())
+				b.ReportMetric(f/(f+float64(b.N)), "cas-failure-rate")
+				b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "updates/s")
+			})
+		}
+	}
+}
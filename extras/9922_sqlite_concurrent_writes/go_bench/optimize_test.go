@@ -0,0 +1,212 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupEvents(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table events (
+			id integer primary key,
+			kind integer not null,
+			user_id integer not null
+		);
+		create index events_kind on events (kind);
+		create index events_user_id on events (user_id)`)
+	return err
+}
+
+// insertEvents appends n events. kind has only two values, user_id is almost
+// unique, so the user_id index is the one to use for queries on both.
+func insertEvents(db *sql.DB, n int) error {
+	return insertSeries(db, `
+		insert into events (kind, user_id)
+		select value % 2, abs(random()) % 1000000 from series`, n)
+}
+
+// BenchmarkOptimizeCadence simulates a long-running service whose events
+// table keeps growing. After each growth phase it measures a query on kind
+// and user_id, and with optimize=periodic it runs PRAGMA optimize, which
+// runs ANALYZE on tables whose statistics are missing or stale.
+// One op is the whole simulation. Should be used with -benchtime=1x.
+func BenchmarkOptimizeCadence(b *testing.B) {
+	const phases, rowsPerPhase, queriesPerPhase = 10, 20000, 50
+	for _, optimize := range []string{"never", "periodic"} {
+		b.Run(fmt.Sprintf("optimize=%s", optimize), func(b *testing.B) {
+			var first, last time.Duration
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				// PRAGMA optimize looks at the queries run on its own connection.
+				db.SetMaxOpenConns(1)
+				noErr(b, setupEvents(db))
+				b.StartTimer()
+				for phase := 0; phase < phases; phase++ {
+					noErr(b, insertEvents(db, rowsPerPhase))
+					start := time.Now()
+					for q := 0; q < queriesPerPhase; q++ {
+						var count int
+						err := db.QueryRow(`select count(*) from events where kind = 1 and user_id between ? and ?`, q*1000, q*1000+100).Scan(&count)
+						noErr(b, err)
+					}
+					elapsed := time.Since(start) / queriesPerPhase
+					if phase == 0 {
+						first += elapsed
+					}
+					if phase == phases-1 {
+						last += elapsed
+					}
+					if optimize == "periodic" {
+						_, err := db.Exec(`pragma optimize`)
+						noErr(b, err)
+					}
+				}
+				noErr(b, db.Close())
+			}
+			b.ReportMetric(float64(first.Nanoseconds())/float64(b.N), "first-phase-ns/query")
+			b.ReportMetric(float64(last.Nanoseconds())/float64(b.N), "last-phase-ns/query")
+		})
+	}
+}
+
+// hasCompileOption reports whether SQLite was built with option, given
+// without the SQLITE_ prefix, e.g. ENABLE_STAT4.
+func hasCompileOption(db *sql.DB, option string) bool {
+	var n int
+	err := db.QueryRow(`select count(*) from pragma_compile_options where compile_options = ?`, option).Scan(&n)
+	return err == nil && n > 0
+}
+
+// setupCars creates n cars with a make and a model, where the model
+// determines the make, and a color. There are 10 makes with one model each,
+// so matching both make and model selects a tenth of the rows, as matching
+// either does, and 1000 colors.
+func setupCars(db *sql.DB, n int) error {
+	_, err := db.Exec(`
+		create table cars (
+			id integer primary key,
+			make integer not null,
+			model integer not null,
+			color integer not null
+		);
+		create index cars_color on cars (color);
+		create index cars_make_model on cars (make, model)`)
+	if err != nil {
+		return err
+	}
+	return insertSeries(db, `
+		insert into cars (make, model, color)
+		select value % 10, value % 10 * 100, abs(random()) % 1000 from series`, n)
+}
+
+// BenchmarkAnalyzeCorrelatedColumns queries cars by make, model and color.
+// Without statistics, the planner assumes an equality on an indexed column
+// matches about 10 rows whatever the column, so cars_make_model, which
+// matches two terms, looks at least as good as cars_color. Here it wins the
+// tie and the query scans a tenth of the table. After ANALYZE,
+// sqlite_stat1 records that the (make, model) prefix matches as many rows as
+// make alone, 10000, and the planner picks cars_color. stat4 reports whether
+// SQLite was built with SQLITE_ENABLE_STAT4, in which case ANALYZE also
+// samples individual values, see BenchmarkStat4SkewedData.
+func BenchmarkAnalyzeCorrelatedColumns(b *testing.B) {
+	for _, analyze := range []bool{false, true} {
+		b.Run(fmt.Sprintf("analyze=%t", analyze), func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			defer db.Close()
+			noErr(b, setupCars(db, 100000))
+			if analyze {
+				_, err := db.Exec(`analyze`)
+				noErr(b, err)
+			}
+			query := `select count(*) from cars where make = ? and model = ? and color = ?`
+			plan := explain(db, query, 1, 100, 1)
+			b.Log(plan)
+			colorIndex := 0.0
+			if strings.Contains(plan, "cars_color") {
+				colorIndex = 1
+			}
+			stat4 := 0.0
+			if hasCompileOption(db, "ENABLE_STAT4") {
+				stat4 = 1
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var n int
+				noErr(b, db.QueryRow(query, i%10, i%10*100, i%1000).Scan(&n))
+			}
+			b.ReportMetric(colorIndex, "color-index")
+			b.ReportMetric(stat4, "stat4")
+		})
+	}
+}
+
+// setupSkewed creates n readings where 99% have kind 0 and the rest are
+// spread over 100 rare kinds, with ts increasing with id.
+func setupSkewed(db *sql.DB, n int) error {
+	_, err := db.Exec(`
+		create table readings (
+			id integer primary key,
+			kind integer not null,
+			ts integer not null
+		);
+		create index readings_kind on readings (kind);
+		create index readings_ts on readings (ts)`)
+	if err != nil {
+		return err
+	}
+	return insertSeries(db, `
+		insert into readings (kind, ts)
+		select case when value % 100 = 0 then value / 100 % 100 + 1 else 0 end, value from series`, n)
+}
+
+// BenchmarkStat4SkewedData queries the last 10% of readings of a common or a
+// rare kind after ANALYZE. With only sqlite_stat1, the planner knows that a
+// kind matches 1% of the rows on average and uses readings_kind for both.
+// With sqlite_stat4, which samples actual values, it knows that kind 0
+// matches almost all rows and uses readings_ts for it instead. stats=stat1
+// deletes the stat4 samples and reloads the statistics. Bound parameters
+// are taken into account because SQLite re-prepares a statement for new
+// bindings when stat4 is enabled. Skipped unless SQLite is built with
+// SQLITE_ENABLE_STAT4, which go-sqlite3 does with -tags sqlite_stat4.
+func BenchmarkStat4SkewedData(b *testing.B) {
+	const rows = 100000
+	for _, stats := range []string{"stat1", "stat4"} {
+		for _, kind := range []string{"common", "rare"} {
+			b.Run(fmt.Sprintf("stats=%s&kind=%s", stats, kind), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				defer db.Close()
+				if !hasCompileOption(db, "ENABLE_STAT4") {
+					b.Skip("SQLite isn't built with SQLITE_ENABLE_STAT4")
+				}
+				noErr(b, setupSkewed(db, rows))
+				_, err := db.Exec(`analyze`)
+				noErr(b, err)
+				if stats == "stat1" {
+					_, err := db.Exec(`delete from sqlite_stat4; analyze sqlite_schema`)
+					noErr(b, err)
+				}
+				value := 0
+				if kind == "rare" {
+					value = 42
+				}
+				query := `select count(*) from readings where kind = ? and ts > ?`
+				plan := explain(db, query, value, rows*9/10)
+				b.Log(plan)
+				tsIndex := 0.0
+				if strings.Contains(plan, "readings_ts") {
+					tsIndex = 1
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var n int
+					noErr(b, db.QueryRow(query, value, rows*9/10).Scan(&n))
+				}
+				b.ReportMetric(tsIndex, "ts-index")
+			})
+		}
+	}
+}
@@ -0,0 +1,781 @@
+package sqlite_bench
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"sqlite_bench/sqliteext"
+)
+
+// BenchmarkWriteCellSizeCheck toggles PRAGMA cell_size_check during writes.
+// With cell_size_check=on, SQLite verifies cell sizes and offsets whenever it
+// parses a b-tree page, so a corrupted database file produces SQLITE_CORRUPT
+// instead of reading garbage or crashing. Without it, only the cheaper
+// checks run.
+func BenchmarkWriteCellSizeCheck(b *testing.B) {
+	for _, check := range []string{"off", "on"} {
+		for _, size := range []int{100, 1000, 10000} {
+			b.Run(fmt.Sprintf("cell_size_check=%s&size=%db", check, size), func(b *testing.B) {
+				options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+				db := makeDBWithPragmas(b, options, "cell_size_check="+check)
+				content := strings.Repeat("A", size)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					err := writeBlogPost(db, content)
+					noErr(b, err)
+				}
+			})
+		}
+	}
+}
+
+// queryInt runs a query that returns a single integer on conn.
+func queryInt(conn *sqlite3.SQLiteConn, query string) (int64, error) {
+	rows, err := conn.Query(query, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	value := make([]driver.Value, 1)
+	if err := rows.Next(value); err != nil {
+		return 0, err
+	}
+	n, ok := value[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("%s returned %v, want an integer", query, value[0])
+	}
+	return n, nil
+}
+
+// trustedSchemaHook sets PRAGMA trusted_schema on every new connection and
+// checks that it took effect, since SQLite ignores unknown pragmas.
+func trustedSchemaHook(trusted string) func(*sqlite3.SQLiteConn) error {
+	return func(conn *sqlite3.SQLiteConn) error {
+		if _, err := conn.Exec("pragma trusted_schema="+trusted, nil); err != nil {
+			return err
+		}
+		got, err := queryInt(conn, "pragma trusted_schema")
+		if err != nil {
+			return err
+		}
+		if (got == 1) != (trusted == "on") {
+			return fmt.Errorf("trusted_schema is %d, want %s", got, trusted)
+		}
+		// An application function that isn't marked innocuous, which views
+		// and triggers can only call while the schema is trusted.
+		return conn.RegisterFunc("side_effect", func() int64 { return 1 }, false)
+	}
+}
+
+// defensiveHook sets SQLITE_DBCONFIG_DEFENSIVE on every new connection with
+// the defensive() function from sqliteext.RegisterDefensive.
+func defensiveHook(defensive string) func(*sqlite3.SQLiteConn) error {
+	return func(conn *sqlite3.SQLiteConn) error {
+		on := 0
+		if defensive == "on" {
+			on = 1
+		}
+		got, err := queryInt(conn, fmt.Sprintf("select defensive(%d)", on))
+		if err != nil {
+			return err
+		}
+		if got != int64(on) {
+			return fmt.Errorf("defensive is %d, want %s", got, defensive)
+		}
+		return nil
+	}
+}
+
+// BenchmarkWriteDefensive measures the write cost of defensive mode, which
+// hardened deployments turn on to forbid direct writes to the schema and
+// shadow tables and other ways to corrupt the database with SQL alone.
+func BenchmarkWriteDefensive(b *testing.B) {
+	noErr(b, sqliteext.RegisterDefensive())
+	for _, defensive := range []string{"off", "on"} {
+		b.Run(fmt.Sprintf("defensive=%s", defensive), func(b *testing.B) {
+			dsn := path.Join(b.TempDir(), "benchmark.db") + "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			db := openWithHook(dsn, defensiveHook(defensive))
+			defer db.Close()
+			noErr(b, setupDB(db))
+			content := strings.Repeat("A", 1000)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := writeBlogPost(db, content)
+				noErr(b, err)
+			}
+		})
+	}
+}
+
+func TestDefensive(t *testing.T) {
+	noErr(t, sqliteext.RegisterDefensive())
+	for _, defensive := range []string{"off", "on"} {
+		t.Run(fmt.Sprintf("defensive=%s", defensive), func(t *testing.T) {
+			db := openWithHook(path.Join(t.TempDir(), "test.db"), defensiveHook(defensive))
+			defer db.Close()
+			noErr(t, setupDB(db))
+			// writable_schema is per connection.
+			db.SetMaxOpenConns(1)
+			_, err := db.Exec(`pragma writable_schema=on`)
+			noErr(t, err)
+			_, err = db.Exec(`update sqlite_schema set sql = sql where name = 'posts'`)
+			if defensive == "off" {
+				noErr(t, err)
+			} else if err == nil || !strings.Contains(err.Error(), "may not be modified") {
+				t.Errorf("updating sqlite_schema in defensive mode: got %v, want it refused", err)
+			}
+		})
+	}
+}
+
+// BenchmarkWriteTrustedSchema measures the write cost of trusted_schema=off,
+// which stops views and triggers in the schema from calling functions with
+// side effects.
+func BenchmarkWriteTrustedSchema(b *testing.B) {
+	for _, trusted := range []string{"on", "off"} {
+		b.Run(fmt.Sprintf("trusted_schema=%s", trusted), func(b *testing.B) {
+			dsn := path.Join(b.TempDir(), "benchmark.db") + "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			db := openWithHook(dsn, trustedSchemaHook(trusted))
+			defer db.Close()
+			noErr(b, setupDB(db))
+			content := strings.Repeat("A", 1000)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := writeBlogPost(db, content)
+				noErr(b, err)
+			}
+		})
+	}
+}
+
+func TestTrustedSchemaOff(t *testing.T) {
+	for _, trusted := range []string{"on", "off"} {
+		t.Run(fmt.Sprintf("trusted_schema=%s", trusted), func(t *testing.T) {
+			db := openWithHook(path.Join(t.TempDir(), "test.db"), trustedSchemaHook(trusted))
+			defer db.Close()
+			_, err := db.Exec(`create view calls as select side_effect() as n`)
+			noErr(t, err)
+			var n int
+			err = db.QueryRow(`select n from calls`).Scan(&n)
+			if trusted == "on" {
+				noErr(t, err)
+			} else if err == nil || !strings.Contains(err.Error(), "unsafe use of side_effect()") {
+				t.Errorf("calling side_effect() from a view: got %v, want an unsafe use error", err)
+			}
+		})
+	}
+}
+
+// BenchmarkReadQueryOnly compares point reads on a connection opened with
+// _query_only=true, as a read pool would use, with a normal connection.
+func BenchmarkReadQueryOnly(b *testing.B) {
+	for _, queryOnly := range []bool{false, true} {
+		b.Run(fmt.Sprintf("query_only=%t", queryOnly), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			db := makeDBAt(b, dbPath, options)
+			noErr(b, insertRowsLoop(db, strings.Repeat("A", 1000), 1000))
+			readDB, err := sql.Open("sqlite3", dbPath+options+fmt.Sprintf("&_query_only=%t", queryOnly))
+			noErr(b, err)
+			defer readDB.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := readBlogPostByID(readDB, int64(i%1000+1))
+				noErr(b, err)
+			}
+		})
+	}
+}
+
+func TestQueryOnlyRejectsWrites(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "test.db")
+	makeDBAt(t, dbPath, "?_journal=WAL").Close()
+	db, err := sql.Open("sqlite3", dbPath+"?_journal=WAL&_query_only=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := readBlogPost(db); err != nil {
+		t.Fatal(err)
+	}
+	err = writeBlogPost(db, "A")
+	if code, _, _ := describeError(err); code != int(sqlite3.ErrReadonly) {
+		t.Fatalf("write on query_only connection: got %v, want SQLITE_READONLY", err)
+	}
+}
+
+// bulkLoad inserts n rows in one transaction. If relaxed, it runs the
+// transaction with synchronous=OFF and restores synchronous=NORMAL after the
+// commit. db must have a single connection, since the pragma is per
+// connection.
+//
+// With synchronous=OFF SQLite doesn't fsync, so a power loss or OS crash
+// before the OS writes the pages out can lose the transaction or corrupt the
+// database, even after the commit returned. An application crash alone is
+// safe. The window stays open after synchronous is restored until the next
+// fsync, which in WAL mode with NORMAL is the next checkpoint.
+func bulkLoad(db *sql.DB, content string, n int, relaxed bool) error {
+	if relaxed {
+		if _, err := db.Exec(`pragma synchronous=OFF`); err != nil {
+			return err
+		}
+		defer db.Exec(`pragma synchronous=NORMAL`)
+	}
+	return insertRowsLoop(db, content, n)
+}
+
+// BenchmarkBulkLoadRelaxedSynchronous compares a bulk-load transaction with
+// synchronous=NORMAL throughout against one that switches to
+// synchronous=OFF for the transaction only. One op is one bulk load.
+func BenchmarkBulkLoadRelaxedSynchronous(b *testing.B) {
+	for _, journal := range []string{"WAL", "DELETE"} {
+		for _, rows := range []int{10000, 100000} {
+			for _, relaxed := range []bool{false, true} {
+				b.Run(fmt.Sprintf("journal=%s&rows=%d&relaxed=%t", journal, rows, relaxed), func(b *testing.B) {
+					db := makeDB(b, fmt.Sprintf("?_journal=%s&_timeout=5000&_fk=true&_synchronous=normal", journal))
+					db.SetMaxOpenConns(1)
+					content := strings.Repeat("A", 1000)
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						err := bulkLoad(db, content, rows, relaxed)
+						noErr(b, err)
+					}
+					b.StopTimer()
+					var sync int
+					noErr(b, db.QueryRow(`pragma synchronous`).Scan(&sync))
+					if sync != 1 {
+						b.Fatalf("synchronous is %d after the load, want 1 (NORMAL)", sync)
+					}
+					b.ReportMetric(float64(b.N*rows)/b.Elapsed().Seconds(), "rows/s")
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkReadSynchronous reads posts by id while a background writer
+// writes at a steady rate, across synchronous settings. synchronous doesn't
+// change how reads are done, but it changes how long the writer and its
+// auto-checkpoints spend in fsync, which readers may or may not notice.
+func BenchmarkReadSynchronous(b *testing.B) {
+	for _, synchronous := range []string{"off", "normal", "full"} {
+		b.Run(fmt.Sprintf("synchronous=%s", synchronous), func(b *testing.B) {
+			db := makeDB(b, fmt.Sprintf("?_journal=WAL&_timeout=5000&_fk=true&_synchronous=%s", synchronous))
+			const rows = 10000
+			content := strings.Repeat("A", 1000)
+			noErr(b, insertRowsLoop(db, content, rows))
+
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			var writes int
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				for ; ; writes++ {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if d := time.Until(start.Add(time.Duration(writes) * steadyWriteInterval)); d > 0 {
+						time.Sleep(d)
+					}
+					if err := writeBlogPost(db, content); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+
+			lats := make(latencies, 0, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				t := time.Now()
+				_, err := readBlogPostByID(db, int64(i%rows+1))
+				lats = append(lats, time.Since(t))
+				noErr(b, err)
+			}
+			b.StopTimer()
+			close(done)
+			wg.Wait()
+			b.ReportMetric(float64(writes)/b.Elapsed().Seconds(), "writes/s")
+			reportLatencies(b, lats, "read-")
+		})
+	}
+}
+
+// BenchmarkShrinkMemory reads random posts through a single connection with
+// a 64 MB page cache and runs PRAGMA shrink_memory on it every interval.
+// shrink_memory frees the connection's cached pages, which later reads have
+// to load again. Whether RSS drops also depends on the allocator returning
+// the memory to the OS. rss-drop-bytes is the average RSS reduction per
+// shrink. Skipped where RSS can't be read.
+func BenchmarkShrinkMemory(b *testing.B) {
+	if _, err := rss(); err != nil {
+		b.Skip(err)
+	}
+	for _, interval := range []time.Duration{0, 10 * time.Millisecond, 100 * time.Millisecond, time.Second} {
+		name := interval.String()
+		if interval == 0 {
+			name = "never"
+		}
+		b.Run(fmt.Sprintf("interval=%s", name), func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal&_cache_size=-64000")
+			defer db.Close()
+			db.SetMaxOpenConns(1)
+			const rows = 30000
+			noErr(b, insertRowsLoop(db, strings.Repeat("A", 1000), rows))
+			start, err := rss()
+			noErr(b, err)
+			var shrinks int
+			var drop, rssMax int64
+			last := time.Now()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := readBlogPostByID(db, rand.Int64N(rows)+1)
+				noErr(b, err)
+				if interval == 0 || time.Since(last) < interval {
+					continue
+				}
+				// Only the shrink and the reads are timed, so that reads/s
+				// doesn't include reading RSS.
+				b.StopTimer()
+				before, err := rss()
+				noErr(b, err)
+				b.StartTimer()
+				_, err = db.Exec(`pragma shrink_memory`)
+				noErr(b, err)
+				b.StopTimer()
+				after, err := rss()
+				noErr(b, err)
+				b.StartTimer()
+				rssMax = max(rssMax, before)
+				drop += before - after
+				shrinks++
+				last = time.Now()
+			}
+			b.StopTimer()
+			final, err := rss()
+			noErr(b, err)
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "reads/s")
+			b.ReportMetric(float64(start), "rss-start-bytes")
+			b.ReportMetric(float64(max(rssMax, final)), "rss-max-bytes")
+			b.ReportMetric(float64(final), "rss-final-bytes")
+			b.ReportMetric(float64(shrinks), "shrinks")
+			if shrinks > 0 {
+				b.ReportMetric(float64(drop)/float64(shrinks), "rss-drop-bytes")
+			}
+		})
+	}
+}
+
+func setupBooks(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table authors (id integer primary key);
+		create table books (
+			id integer primary key,
+			author_id integer not null references authors (id)
+		);
+		insert into authors (id) values (1)`)
+	return err
+}
+
+// insertBookFKOff inserts a book by authorID in a transaction with
+// foreign_keys turned off around it. If inTx, the pragma runs inside the
+// transaction, where SQLite silently ignores it. conn must stay pinned so
+// the pragma and the transaction run on the same connection.
+func insertBookFKOff(ctx context.Context, conn *sql.Conn, authorID int64, inTx bool) error {
+	if !inTx {
+		if _, err := conn.ExecContext(ctx, `pragma foreign_keys = off`); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `pragma foreign_keys = on`)
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if inTx {
+		if _, err := tx.Exec(`pragma foreign_keys = off`); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`insert into books (author_id) values (?)`, authorID); err != nil {
+		return err
+	}
+	if inTx {
+		if _, err := tx.Exec(`pragma foreign_keys = on`); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// TestForeignKeysToggleInTx checks that turning foreign_keys off works
+// around a transaction but is a no-op inside one.
+func TestForeignKeysToggleInTx(t *testing.T) {
+	db := makeDB(t, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+	noErr(t, setupBooks(db))
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	noErr(t, err)
+	defer conn.Close()
+
+	if err := insertBookFKOff(ctx, conn, 2, true); err == nil {
+		t.Error("foreign_keys=off inside a transaction allowed a dangling author_id")
+	}
+	noErr(t, insertBookFKOff(ctx, conn, 2, false))
+	var fk int
+	noErr(t, conn.QueryRowContext(ctx, `pragma foreign_keys`).Scan(&fk))
+	if fk != 1 {
+		t.Errorf("foreign_keys is %d after the toggle, want 1", fk)
+	}
+}
+
+// BenchmarkForeignKeysToggle inserts a book per op with foreign keys on,
+// with foreign_keys toggled off and on around every transaction, and with
+// the toggle inside the transaction, where it does nothing.
+func BenchmarkForeignKeysToggle(b *testing.B) {
+	for _, mode := range []string{"none", "toggle", "toggle-in-tx"} {
+		b.Run(fmt.Sprintf("mode=%s", mode), func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			noErr(b, setupBooks(db))
+			ctx := context.Background()
+			conn, err := db.Conn(ctx)
+			noErr(b, err)
+			defer conn.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var err error
+				if mode == "none" {
+					var tx *sql.Tx
+					tx, err = conn.BeginTx(ctx, nil)
+					noErr(b, err)
+					_, err = tx.Exec(`insert into books (author_id) values (1)`)
+					noErr(b, err)
+					err = tx.Commit()
+				} else {
+					err = insertBookFKOff(ctx, conn, 1, mode == "toggle-in-tx")
+				}
+				noErr(b, err)
+			}
+		})
+	}
+}
+
+func isFull(err error) bool {
+	code, _, _ := describeError(err)
+	return code == int(sqlite3.ErrFull)
+}
+
+// TestMaxPageCountFull fills a database capped with max_page_count and checks
+// that the insert over the limit fails with SQLITE_FULL without losing the
+// rows written before it, and that deleting rows makes room again.
+func TestMaxPageCountFull(t *testing.T) {
+	db := makeDBWithPragmas(t, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal", "max_page_count=20")
+	defer db.Close()
+	content := strings.Repeat("A", 1000)
+	inserted := 0
+	var err error
+	for ; inserted < 1000; inserted++ {
+		if err = writeBlogPost(db, content); err != nil {
+			break
+		}
+	}
+	if !isFull(err) {
+		t.Fatalf("insert over max_page_count: got %v, want SQLITE_FULL", err)
+	}
+	var count int
+	noErr(t, db.QueryRow(`select count(*) from posts`).Scan(&count))
+	if count != inserted {
+		t.Errorf("got %d rows after %d successful inserts", count, inserted)
+	}
+
+	// In a transaction, SQLITE_FULL rolls back the whole transaction, not
+	// just the failed statement, so the rows it wrote before are gone and
+	// Commit fails.
+	_, err = db.Exec(`delete from posts where id <= 8`)
+	noErr(t, err)
+	tx, err := db.Begin()
+	noErr(t, err)
+	txInserted := 0
+	for ; txInserted < 1000; txInserted++ {
+		if _, err = tx.Exec(`insert into posts (content) values (?)`, content); err != nil {
+			break
+		}
+	}
+	if !isFull(err) {
+		t.Fatalf("insert over max_page_count in a transaction: got %v, want SQLITE_FULL", err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Error("committed a transaction after SQLITE_FULL")
+	}
+	noErr(t, db.QueryRow(`select count(*) from posts`).Scan(&count))
+	if want := inserted - 8; count != want {
+		t.Errorf("got %d rows after rollback, want %d", count, want)
+	}
+	if txInserted == 0 {
+		t.Error("deleting rows didn't make room for new ones")
+	}
+}
+
+// BenchmarkMaxPageCount compares inserts into a database capped with
+// max_page_count while it still has room with inserts that are rejected
+// with SQLITE_FULL once it's at the limit. For state=full, fill reports how
+// much of the capped size is taken up by row content when the first insert
+// fails.
+func BenchmarkMaxPageCount(b *testing.B) {
+	const pages = 1000
+	content := strings.Repeat("A", 1000)
+	for _, state := range []string{"room", "full"} {
+		b.Run(fmt.Sprintf("state=%s", state), func(b *testing.B) {
+			limit := pages
+			if state == "room" {
+				limit = 1 << 30
+			}
+			db := makeDBWithPragmas(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal",
+				fmt.Sprintf("max_page_count=%d", limit))
+			defer db.Close()
+			fill := 0.0
+			if state == "full" {
+				inserted := 0
+				for {
+					err := writeBlogPost(db, content)
+					if isFull(err) {
+						break
+					}
+					noErr(b, err)
+					inserted++
+				}
+				var pageSize int
+				noErr(b, db.QueryRow(`pragma page_size`).Scan(&pageSize))
+				fill = float64(inserted*len(content)) / float64(pages*pageSize)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := writeBlogPost(db, content)
+				if state == "full" && isFull(err) {
+					continue
+				}
+				noErr(b, err)
+			}
+			if state == "full" {
+				b.ReportMetric(fill, "fill")
+			}
+		})
+	}
+}
+
+// BenchmarkMmapScan scans a 64 MB posts table, much larger than the default
+// 2 MB page cache, with mmap_size large enough to map the whole database or
+// with mmap disabled. Without mmap, SQLite reads every page into its page
+// cache with a read call, which copies it out of the OS page cache. With
+// mmap, it reads pages directly from the mapping. Both read from the OS page
+// cache after the first op, so this is the CPU cost of the read path, not
+// I/O.
+func BenchmarkMmapScan(b *testing.B) {
+	const rows = 64000
+	dbPath := path.Join(b.TempDir(), "benchmark.db")
+	options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+	db := makeDBAt(b, dbPath, options)
+	noErr(b, insertRowsLoop(db, strings.Repeat("A", 1000), rows))
+	_, err := db.Exec(`pragma wal_checkpoint(TRUNCATE)`)
+	noErr(b, err)
+	noErr(b, db.Close())
+	size := fileSize(dbPath)
+	for _, mmapSize := range []int64{0, 1 << 30} {
+		b.Run(fmt.Sprintf("mmap_size=%d", mmapSize), func(b *testing.B) {
+			db := openWithPragmas(dbPath+options, fmt.Sprintf("mmap_size=%d", mmapSize))
+			defer db.Close()
+			var got int64
+			noErr(b, db.QueryRow(`pragma mmap_size`).Scan(&got))
+			if got != mmapSize {
+				b.Fatalf("mmap_size is %d, SQLite is probably built with a lower SQLITE_MAX_MMAP_SIZE", got)
+			}
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var total int
+				noErr(b, db.QueryRow(`select sum(length(content)) from posts`).Scan(&total))
+				if total != rows*1000 {
+					b.Fatalf("scanned %d bytes of content, want %d", total, rows*1000)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFirstReadCacheWarmth opens a new pool on a 64 MB database and
+// times its first point read. With cache=cold, the database file is dropped
+// from the OS page cache before every op, so the read, including loading
+// the schema, goes to disk. With cache=warm, it's served from the OS page
+// cache, and the difference is the I/O that benchmarks on a warm cache
+// don't see. In a VM, the host may still cache the disk image, which makes
+// cold reads faster than on real hardware. cache=cold is skipped where the
+// page cache can't be dropped.
+func BenchmarkFirstReadCacheWarmth(b *testing.B) {
+	const rows = 64000
+	dbPath := path.Join(b.TempDir(), "benchmark.db")
+	options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+	db := makeDBAt(b, dbPath, options)
+	noErr(b, insertRowsLoop(db, strings.Repeat("A", 1000), rows))
+	_, err := db.Exec(`pragma wal_checkpoint(TRUNCATE)`)
+	noErr(b, err)
+	noErr(b, db.Close())
+	for _, cache := range []string{"cold", "warm"} {
+		b.Run(fmt.Sprintf("cache=%s", cache), func(b *testing.B) {
+			if cache == "cold" {
+				if err := dropPageCache(dbPath); err != nil {
+					b.Skip(err)
+				}
+			}
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if cache == "cold" {
+					noErr(b, dropPageCache(dbPath))
+				}
+				db, err := sql.Open("sqlite3", dbPath+options)
+				noErr(b, err)
+				b.StartTimer()
+				_, err = readBlogPostByID(db, rand.Int64N(rows)+1)
+				noErr(b, err)
+				b.StopTimer()
+				noErr(b, db.Close())
+			}
+		})
+	}
+}
+
+// unorderedQueries run queries from other benchmarks that don't have an
+// order by on a fresh database and return what they read or left behind.
+// dependsOnOrder says whether the result changes with the row order.
+var unorderedQueries = []struct {
+	name           string
+	dependsOnOrder bool
+	run            func(db *sql.DB) (string, error)
+}{
+	{
+		// claimJob claims the newest pending job instead of the oldest with
+		// the order reversed. BenchmarkJobQueueClaim only counts claims, so
+		// its results don't change, but a queue that should be FIFO needs an
+		// order by id.
+		name:           "claim-job",
+		dependsOnOrder: true,
+		run: func(db *sql.DB) (string, error) {
+			if err := setupJobs(db, 10); err != nil {
+				return "", err
+			}
+			var ids []string
+			for range 3 {
+				id, err := claimJob(db)
+				if err != nil {
+					return "", err
+				}
+				ids = append(ids, fmt.Sprint(id))
+			}
+			return strings.Join(ids, ","), nil
+		},
+	},
+	{
+		// readInTx reads a post with readAnyPost just to start its read
+		// transaction, so which one it gets doesn't matter.
+		name:           "read-in-tx",
+		dependsOnOrder: true,
+		run: func(db *sql.DB) (string, error) {
+			for i := range 10 {
+				if err := writeBlogPost(db, fmt.Sprint(i)); err != nil {
+					return "", err
+				}
+			}
+			return readAnyPost(db)
+		},
+	},
+	{
+		// Each batch deletes other rows with the order reversed, but all of
+		// them are deleted in the end.
+		name:           "delete-batched",
+		dependsOnOrder: false,
+		run: func(db *sql.DB) (string, error) {
+			if err := insertRowsLoop(db, "A", 100); err != nil {
+				return "", err
+			}
+			if _, err := deleteBatched(db, 50, 10, 0); err != nil {
+				return "", err
+			}
+			var count, minID int
+			err := db.QueryRow(`select count(*), min(id) from posts`).Scan(&count, &minID)
+			return fmt.Sprintf("%d rows from %d", count, minID), err
+		},
+	},
+}
+
+// TestReverseUnorderedSelects runs queries without an order by with PRAGMA
+// reverse_unordered_selects off and on. With it on, SQLite scans tables and
+// indexes in reverse where the order isn't specified, so a query whose
+// result changes with it depends on the order rows happen to be stored in.
+// Only claimJob's result does in a way that could matter to an application.
+// None of the benchmarks' reported results depend on row order.
+func TestReverseUnorderedSelects(t *testing.T) {
+	options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+	for _, q := range unorderedQueries {
+		t.Run(q.name, func(t *testing.T) {
+			var results [2]string
+			for i, reverse := range []string{"off", "on"} {
+				db := makeDBWithPragmas(t, options, "reverse_unordered_selects = "+reverse)
+				result, err := q.run(db)
+				noErr(t, err)
+				noErr(t, db.Close())
+				results[i] = result
+			}
+			if depends := results[0] != results[1]; depends != q.dependsOnOrder {
+				t.Errorf("got %q in stored order and %q reversed, want dependsOnOrder=%t",
+					results[0], results[1], q.dependsOnOrder)
+			}
+		})
+	}
+}
+
+// BenchmarkReverseUnorderedSelects scans 100000 posts with
+// reverse_unordered_selects off and on, through the table and through an
+// index. A reversed table scan walks the same pages from the other end and
+// costs the same. The index scan has a lower bound: forward, SQLite seeks to
+// it once and reads to the end of the index, but reversed it starts at the
+// end and compares every key with the bound to know where to stop, which
+// made it about 50% slower. The pragma is meant for auditing query results
+// in tests, so this rarely matters, but timings taken with it on aren't
+// comparable.
+func BenchmarkReverseUnorderedSelects(b *testing.B) {
+	const rows = 100000
+	scans := map[string]string{
+		"table": `select sum(length(content)) from posts`,
+		"index": `select count(*) from posts where content >= ''`,
+	}
+	for _, scan := range []string{"table", "index"} {
+		for _, reverse := range []string{"off", "on"} {
+			b.Run(fmt.Sprintf("scan=%s&reverse=%s", scan, reverse), func(b *testing.B) {
+				options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+				db := makeDBWithPragmas(b, options, "reverse_unordered_selects = "+reverse)
+				defer db.Close()
+				noErr(b, insertRowsLoop(db, strings.Repeat("A", 100), rows))
+				_, err := db.Exec(`create index posts_content on posts (content)`)
+				noErr(b, err)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var n int
+					noErr(b, db.QueryRow(scans[scan]).Scan(&n))
+				}
+			})
+		}
+	}
+}
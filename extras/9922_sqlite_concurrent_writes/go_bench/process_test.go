@@ -0,0 +1,182 @@
+package sqlite_bench
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHelperProcessWriter is not a real test. BenchmarkWriteMultiProcess runs
+// the test binary with SQLITE_BENCH_HELPER=writer to get a separate writer
+// process. It writes SQLITE_BENCH_WRITES rows to SQLITE_BENCH_DSN and prints
+// its start and end time and the number of locked errors.
+func TestHelperProcessWriter(t *testing.T) {
+	if os.Getenv("SQLITE_BENCH_HELPER") != "writer" {
+		t.Skip("only runs as a helper process")
+	}
+	writes, err := strconv.Atoi(os.Getenv("SQLITE_BENCH_WRITES"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", os.Getenv("SQLITE_BENCH_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	content := strings.Repeat("A", 1000)
+	locked := 0
+	start := time.Now()
+	for i := 0; i < writes; i++ {
+		err := writeBlogPost(db, content)
+		if isBusy(err) {
+			locked++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fmt.Printf("helper: %d %d %d\n", start.UnixNano(), time.Now().UnixNano(), locked)
+}
+
+type helperResult struct {
+	start, end time.Time
+	locked     int
+}
+
+func runWriterProcesses(dsn string, procs int, writesPerProc int) ([]helperResult, error) {
+	cmds := make([]*exec.Cmd, procs)
+	outs := make([]bytes.Buffer, procs)
+	for i := range cmds {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcessWriter$", "-test.bench=^$")
+		cmd.Env = append(os.Environ(),
+			"SQLITE_BENCH_HELPER=writer",
+			"SQLITE_BENCH_DSN="+dsn,
+			fmt.Sprintf("SQLITE_BENCH_WRITES=%d", writesPerProc),
+		)
+		cmd.Stdout = &outs[i]
+		cmd.Stderr = &outs[i]
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		cmds[i] = cmd
+	}
+	results := make([]helperResult, procs)
+	for i, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			return nil, fmt.Errorf("helper %d: %w: %s", i, err, outs[i].String())
+		}
+		var start, end int64
+		var locked int
+		line := outs[i].String()
+		if j := strings.Index(line, "helper: "); j >= 0 {
+			line = line[j:]
+		}
+		if _, err := fmt.Sscanf(line, "helper: %d %d %d", &start, &end, &locked); err != nil {
+			return nil, fmt.Errorf("helper %d: %w: %s", i, err, outs[i].String())
+		}
+		results[i] = helperResult{time.Unix(0, start), time.Unix(0, end), locked}
+	}
+	return results, nil
+}
+
+// BenchmarkWriteMultiProcess splits b.N writes across separate processes
+// writing to the same database file, so locking goes through the OS file
+// locks instead of a shared in-process SQLite. Throughput is computed from
+// the window between the first process start and the last process end, so
+// the process startup cost isn't included.
+func BenchmarkWriteMultiProcess(b *testing.B) {
+	for _, procs := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("processes=%d", procs), func(b *testing.B) {
+			dbPath := path.Join(b.TempDir(), "benchmark.db")
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			db := makeDBAt(b, dbPath, options)
+			db.Close()
+			writesPerProc := max(b.N/procs, 1)
+			results, err := runWriterProcesses(dbPath+options, procs, writesPerProc)
+			noErr(b, err)
+			first, last := results[0].start, results[0].end
+			locked := 0
+			for _, r := range results {
+				if r.start.Before(first) {
+					first = r.start
+				}
+				if r.end.After(last) {
+					last = r.end
+				}
+				locked += r.locked
+			}
+			b.ReportMetric(float64(writesPerProc*procs)/last.Sub(first).Seconds(), "writes/s")
+			b.ReportMetric(float64(locked), "locked-errors")
+		})
+	}
+}
+
+// TestHelperProcessCrash is not a real test. runCrashProcess runs the test
+// binary with SQLITE_BENCH_HELPER=crash to get a process that commits
+// SQLITE_BENCH_COMMITS rows to SQLITE_BENCH_DSN one per transaction, prints
+// the number it committed and how long that took, then rewrites the content
+// of every row in a transaction and exits in the middle of it without
+// closing the database, as an application crash would. A page cache smaller
+// than the database, set in the DSN, makes SQLite spill some of the
+// uncommitted pages to the database file before the exit.
+func TestHelperProcessCrash(t *testing.T) {
+	if os.Getenv("SQLITE_BENCH_HELPER") != "crash" {
+		t.Skip("only runs as a helper process")
+	}
+	commits, err := strconv.Atoi(os.Getenv("SQLITE_BENCH_COMMITS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", os.Getenv("SQLITE_BENCH_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	content := strings.Repeat("A", 1000)
+	start := time.Now()
+	for i := 0; i < commits; i++ {
+		if err := writeBlogPost(db, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fmt.Printf("helper: %d %d\n", commits, time.Since(start).Nanoseconds())
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`update posts set content = ?`, strings.Repeat("B", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+// runCrashProcess runs TestHelperProcessCrash on dsn and returns the number
+// of rows it committed before crashing and how long the commits took.
+func runCrashProcess(dsn string, commits int) (int, time.Duration, error) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcessCrash$", "-test.bench=^$")
+	cmd.Env = append(os.Environ(),
+		"SQLITE_BENCH_HELPER=crash",
+		"SQLITE_BENCH_DSN="+dsn,
+		fmt.Sprintf("SQLITE_BENCH_COMMITS=%d", commits),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, 0, fmt.Errorf("helper: %w: %s", err, out)
+	}
+	line := string(out)
+	if j := strings.Index(line, "helper: "); j >= 0 {
+		line = line[j:]
+	}
+	var committed int
+	var elapsed int64
+	if _, err := fmt.Sscanf(line, "helper: %d %d", &committed, &elapsed); err != nil {
+		return 0, 0, fmt.Errorf("helper: %w: %s", err, out)
+	}
+	return committed, time.Duration(elapsed), nil
+}
@@ -0,0 +1,463 @@
+package sqlite_bench
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupComments creates an unindexed comments table with perPost comments for
+// each of the posts rows, so joins on post_id can only use automatic indexes.
+func setupComments(db *sql.DB, posts int, perPost int) error {
+	if err := insertRowsLoop(db, strings.Repeat("A", 100), posts); err != nil {
+		return err
+	}
+	_, err := db.Exec(`
+		create table comments (
+			id integer primary key,
+			post_id integer not null,
+			content text not null
+		)`)
+	if err != nil {
+		return err
+	}
+	return insertSeries(db, `
+		insert into comments (post_id, content)
+		select (value - 1) % ? + 1, 'comment' from series`, posts*perPost, posts)
+}
+
+// BenchmarkQueryAutomaticIndex self-joins comments on the unindexed post_id
+// with PRAGMA automatic_index on and off. For many lookups SQLite builds a
+// transient index that pays for itself. For a few lookups the index is
+// built and thrown away.
+func BenchmarkQueryAutomaticIndex(b *testing.B) {
+	query := `
+		select count(*) from comments c1 join comments c2 on c2.post_id = c1.post_id
+		where c1.id <= ?`
+	for _, lookups := range []int{3, 1000} {
+		for _, autoIndex := range []string{"on", "off"} {
+			b.Run(fmt.Sprintf("lookups=%d&automatic_index=%s", lookups, autoIndex), func(b *testing.B) {
+				options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+				db := makeDBWithPragmas(b, options, "automatic_index="+autoIndex)
+				noErr(b, setupComments(db, 1000, 10))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var count int
+					err := db.QueryRow(query, lookups).Scan(&count)
+					noErr(b, err)
+				}
+			})
+		}
+	}
+}
+
+// explain returns the EXPLAIN QUERY PLAN output of query, one line per plan
+// step. It's meant for logging, so errors are returned as text.
+func explain(db *sql.DB, query string, args ...any) string {
+	rows, err := db.Query("explain query plan "+query, args...)
+	if err != nil {
+		return "explain: " + err.Error()
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var id, parent, notused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notused, &detail); err != nil {
+			return "explain: " + err.Error()
+		}
+		lines = append(lines, detail)
+	}
+	if err := rows.Err(); err != nil {
+		return "explain: " + err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// BenchmarkExplainBeforeQuery measures the cost of collecting the query plan
+// before every query, as some slow-query loggers do.
+func BenchmarkExplainBeforeQuery(b *testing.B) {
+	for _, withExplain := range []bool{false, true} {
+		b.Run(fmt.Sprintf("explain=%t", withExplain), func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			noErr(b, insertRowsLoop(db, strings.Repeat("A", 100), 1000))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				id := int64(i%1000 + 1)
+				if withExplain {
+					if plan := explain(db, `select content from posts where id = ?`, id); plan == "" {
+						b.Fatal("empty plan")
+					}
+				}
+				_, err := readBlogPostByID(db, id)
+				noErr(b, err)
+			}
+		})
+	}
+}
+
+// setupTags creates a tags table with n random lowercase names, indexed
+// with the given collation.
+func setupTags(db *sql.DB, n int, collation string) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		create table tags (id integer primary key, name text not null);
+		create index tags_name on tags (name collate %s)`, collation))
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`insert into tags (name) values (?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%s-%s-%d", words[rand.IntN(len(words))], words[rand.IntN(len(words))], i)
+		if _, err := stmt.Exec(name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// BenchmarkPrefixLikeCaseSensitivity runs prefix LIKE queries on an indexed
+// column. SQLite only uses the index for LIKE if its collation matches
+// case_sensitive_like: NOCASE when it's off (the default), BINARY when it's
+// on. _cslike sets it per connection. index-seek is 1 if the plan searches
+// the index and 0 if it scans the table.
+func BenchmarkPrefixLikeCaseSensitivity(b *testing.B) {
+	for _, collation := range []string{"binary", "nocase"} {
+		for _, cslike := range []bool{false, true} {
+			b.Run(fmt.Sprintf("index=%s&cslike=%t", collation, cslike), func(b *testing.B) {
+				db := makeDB(b, fmt.Sprintf("?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal&_cslike=%t", cslike))
+				noErr(b, setupTags(db, 100000, collation))
+				query := `select count(*) from tags where name like ?`
+				plan := explain(db, query, "a%")
+				b.Log(plan)
+				seek := 0.0
+				if strings.Contains(plan, "SEARCH") {
+					seek = 1
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var n int
+					prefix := words[i%len(words)][:2] + "%"
+					noErr(b, db.QueryRow(query, prefix).Scan(&n))
+				}
+				b.ReportMetric(seek, "index-seek")
+			})
+		}
+	}
+}
+
+// BenchmarkExecVsQueryInsert compares inserting a post with Exec against
+// Query, which also has to be drained and closed. A vet-style check could
+// flag Query calls whose SQL starts with insert, update or delete and has no
+// returning clause, and Exec calls whose SQL starts with select.
+func BenchmarkExecVsQueryInsert(b *testing.B) {
+	for _, method := range []string{"exec", "query"} {
+		b.Run(fmt.Sprintf("method=%s", method), func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			content := strings.Repeat("A", 1000)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if method == "exec" {
+					_, err := db.Exec(`insert into posts (content) values (?)`, content)
+					noErr(b, err)
+					continue
+				}
+				rows, err := db.Query(`insert into posts (content) values (?)`, content)
+				noErr(b, err)
+				for rows.Next() {
+				}
+				noErr(b, rows.Err())
+				noErr(b, rows.Close())
+			}
+		})
+	}
+}
+
+// TestQueryInsertNeedsNext shows why Query is the wrong call for statements
+// that return no rows. go-sqlite3 only steps the statement in rows.Next, so
+// the insert doesn't happen until Next is called, and the connection stays
+// checked out until the rows are closed. The inverse mistake, Exec for a
+// select, steps the statement once and drops the first row, as readBlogPost
+// does.
+func TestQueryInsertNeedsNext(t *testing.T) {
+	db := makeDB(t, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+	count := func() int {
+		var n int
+		noErr(t, db.QueryRow(`select count(*) from posts`).Scan(&n))
+		return n
+	}
+
+	rows, err := db.Query(`insert into posts (content) values ('A')`)
+	noErr(t, err)
+	if inUse := db.Stats().InUse; inUse != 1 {
+		t.Errorf("%d connections in use with the rows open, want 1", inUse)
+	}
+	noErr(t, rows.Close())
+	if n := count(); n != 0 {
+		t.Errorf("got %d posts after closing the rows without Next, want 0", n)
+	}
+	if inUse := db.Stats().InUse; inUse != 0 {
+		t.Errorf("%d connections in use after closing the rows, want 0", inUse)
+	}
+
+	rows, err = db.Query(`insert into posts (content) values ('A')`)
+	noErr(t, err)
+	if rows.Next() {
+		t.Error("insert returned a row")
+	}
+	noErr(t, rows.Close())
+	if n := count(); n != 1 {
+		t.Errorf("got %d posts after Next, want 1", n)
+	}
+}
+
+// BenchmarkSortTempStore runs a sort that doesn't fit in the cache and
+// spills to temporary files, with the temp store in memory or in
+// directories on different filesystems. The directory is set with the
+// deprecated temp_store_directory pragma, which applies to the whole
+// process. Outside of benchmarks, setting SQLITE_TMPDIR or TMPDIR has the
+// same effect. Set SQLITE_BENCH_DIR to also try a directory of your choice.
+func BenchmarkSortTempStore(b *testing.B) {
+	type location struct{ name, dir string }
+	locations := []location{{"memory", ""}}
+	dirs := []string{"/dev/shm", os.TempDir()}
+	if dir := os.Getenv("SQLITE_BENCH_DIR"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		fs, _, err := filesystemType(dir)
+		noErr(b, err)
+		locations = append(locations, location{fs, dir})
+	}
+	db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal&_cache_size=-1000")
+	db.SetMaxOpenConns(1)
+	const rows = 20000
+	tx, err := db.Begin()
+	noErr(b, err)
+	for i := 0; i < rows; i++ {
+		_, err := tx.Exec(`insert into posts (content) values (?)`, makeContent("medium", 1000))
+		noErr(b, err)
+	}
+	noErr(b, tx.Commit())
+	defer db.Exec(`pragma temp_store_directory = ''`)
+	for _, loc := range locations {
+		b.Run(fmt.Sprintf("location=%s", loc.name), func(b *testing.B) {
+			var err error
+			if loc.dir == "" {
+				_, err = db.Exec(`pragma temp_store = memory`)
+			} else {
+				_, err = db.Exec(fmt.Sprintf(`pragma temp_store = file; pragma temp_store_directory = '%s'`, loc.dir))
+			}
+			noErr(b, err)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r, err := db.Query(`select content from posts order by content`)
+				noErr(b, err)
+				n := 0
+				for r.Next() {
+					n++
+				}
+				noErr(b, r.Err())
+				noErr(b, r.Close())
+				if n != rows {
+					b.Fatalf("sorted %d rows, want %d", n, rows)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkContextCancellation measures what a cancelable context costs when
+// it never fires. With a context whose Done channel is nil, such as
+// context.Background, go-sqlite3 steps statements directly. With any other
+// context, it steps them in a new goroutine and waits for either the result
+// or Done, so that it can call sqlite3_interrupt. That's a goroutine per
+// Exec and per rows.Next, so a scan pays it for every row.
+func BenchmarkContextCancellation(b *testing.B) {
+	for _, query := range []string{"point", "scan-1000"} {
+		for _, ctxKind := range []string{"background", "cancel", "timeout"} {
+			b.Run(fmt.Sprintf("query=%s&ctx=%s", query, ctxKind), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				defer db.Close()
+				noErr(b, insertRowsLoop(db, strings.Repeat("A", 100), 1000))
+				ctx := context.Background()
+				switch ctxKind {
+				case "cancel":
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithCancel(ctx)
+					defer cancel()
+				case "timeout":
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, time.Hour)
+					defer cancel()
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if query == "point" {
+						var content string
+						noErr(b, db.QueryRowContext(ctx, `select content from posts where id = ?`, i%1000+1).Scan(&content))
+						continue
+					}
+					rows, err := db.QueryContext(ctx, `select content from posts`)
+					noErr(b, err)
+					for rows.Next() {
+						var content string
+						noErr(b, rows.Scan(&content))
+					}
+					noErr(b, rows.Err())
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkInterruptLatency cancels a query that would never finish, a count
+// over an unbounded recursive CTE, 1ms after it started, and reports how
+// long it took from cancel to the query returning.
+func BenchmarkInterruptLatency(b *testing.B) {
+	db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+	defer db.Close()
+	var lats latencies
+	for i := 0; i < b.N; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		var canceled time.Time
+		timer := time.AfterFunc(time.Millisecond, func() {
+			canceled = time.Now()
+			cancel()
+		})
+		var n int
+		err := db.QueryRowContext(ctx, `
+			with recursive series(value) as (
+				select 1 union all select value + 1 from series
+			)
+			select count(*) from series`).Scan(&n)
+		returned := time.Now()
+		timer.Stop()
+		cancel()
+		if !errors.Is(err, context.Canceled) {
+			b.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+		lats = append(lats, returned.Sub(canceled))
+	}
+	reportLatencies(b, lats, "interrupt-")
+}
+
+// loadPostsWithComments fetches n posts starting at id from and all their
+// comments, and returns the number of comments. With method=n+1 it queries
+// the comments of each post separately, with method=in it queries them for
+// all posts with one IN list, and with method=join it fetches posts and
+// comments in one query.
+func loadPostsWithComments(db *sql.DB, method string, from int64, n int) (int, error) {
+	if method == "join" {
+		rows, err := db.Query(`
+			select p.id, p.content, c.content from posts p join comments c on c.post_id = p.id
+			where p.id >= ? and p.id < ?`, from, from+int64(n))
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+		comments := 0
+		for rows.Next() {
+			var id int64
+			var post, comment string
+			if err := rows.Scan(&id, &post, &comment); err != nil {
+				return 0, err
+			}
+			comments++
+		}
+		return comments, rows.Err()
+	}
+
+	rows, err := db.Query(`select id, content from posts where id >= ? order by id limit ?`, from, n)
+	if err != nil {
+		return 0, err
+	}
+	var ids []any
+	for rows.Next() {
+		var id int64
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	queryComments := func(query string, args ...any) (int, error) {
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+		comments := 0
+		for rows.Next() {
+			var postID int64
+			var content string
+			if err := rows.Scan(&postID, &content); err != nil {
+				return 0, err
+			}
+			comments++
+		}
+		return comments, rows.Err()
+	}
+	if method == "in" {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+		return queryComments(`select post_id, content from comments where post_id in (`+placeholders+`)`, ids...)
+	}
+	comments := 0
+	for _, id := range ids {
+		n, err := queryComments(`select post_id, content from comments where post_id = ?`, id)
+		if err != nil {
+			return 0, err
+		}
+		comments += n
+	}
+	return comments, nil
+}
+
+// BenchmarkNPlusOneQueries loads n posts with their 5 comments each, with a
+// query per post, an IN list or a join. comments are indexed by post_id.
+// One op loads all n posts.
+func BenchmarkNPlusOneQueries(b *testing.B) {
+	const posts, perPost = 2000, 5
+	for _, n := range []int{10, 100, 1000} {
+		for _, method := range []string{"n+1", "in", "join"} {
+			b.Run(fmt.Sprintf("posts=%d&method=%s", n, method), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				defer db.Close()
+				noErr(b, setupComments(db, posts, perPost))
+				_, err := db.Exec(`create index comments_post_id on comments (post_id)`)
+				noErr(b, err)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					comments, err := loadPostsWithComments(db, method, rand.Int64N(posts-int64(n))+1, n)
+					noErr(b, err)
+					if comments != n*perPost {
+						b.Fatalf("got %d comments, want %d", comments, n*perPost)
+					}
+				}
+			})
+		}
+	}
+}
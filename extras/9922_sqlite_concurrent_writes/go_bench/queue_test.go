@@ -0,0 +1,84 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupJobs(db *sql.DB, n int) error {
+	_, err := db.Exec(`
+		create table jobs (
+			id integer primary key,
+			status text not null default 'pending',
+			payload text not null
+		);
+		create index jobs_status on jobs (status)`)
+	if err != nil {
+		return err
+	}
+	return insertSeries(db, `insert into jobs (payload) select 'job' from series`, n)
+}
+
+// claimJob marks one pending job as claimed and returns its id, or
+// sql.ErrNoRows if there are no pending jobs. SQLite has no
+// SELECT ... FOR UPDATE SKIP LOCKED, but since writes are serialized, the
+// subquery and the update see the same pending job and no other writer can
+// claim it in between.
+func claimJob(db *sql.DB) (int64, error) {
+	var id int64
+	err := db.QueryRow(`
+		update jobs set status = 'claimed'
+		where id = (select id from jobs where status = 'pending' limit 1)
+		returning id`).Scan(&id)
+	return id, err
+}
+
+// BenchmarkJobQueueClaim runs workers that claim b.N jobs until the queue is
+// empty, and reports claim throughput and how many jobs were claimed twice.
+func BenchmarkJobQueueClaim(b *testing.B) {
+	for _, workers := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			noErr(b, setupJobs(db, b.N))
+			var mu sync.Mutex
+			claims := make(map[int64]int, b.N)
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			start := time.Now()
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						id, err := claimJob(db)
+						if errors.Is(err, sql.ErrNoRows) {
+							return
+						}
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						mu.Lock()
+						claims[id]++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+			doubleClaims := 0
+			for _, n := range claims {
+				doubleClaims += n - 1
+			}
+			if len(claims) != b.N {
+				b.Errorf("claimed %d jobs, want %d", len(claims), b.N)
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "claims/s")
+			b.ReportMetric(float64(doubleClaims), "double-claims")
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package sqlite_bench
+
+import (
+	"fmt"
+	"os"
+)
+
+// rss returns the resident set size of the process.
+func rss() (int64, error) {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	var size, resident int64
+	if _, err := fmt.Sscan(string(data), &size, &resident); err != nil {
+		return 0, err
+	}
+	return resident * int64(os.Getpagesize()), nil
+}
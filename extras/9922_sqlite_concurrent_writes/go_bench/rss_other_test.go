@@ -0,0 +1,9 @@
+//go:build !linux
+
+package sqlite_bench
+
+import "errors"
+
+func rss() (int64, error) {
+	return 0, errors.New("rss is only supported on linux")
+}
@@ -0,0 +1,251 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// wideRow is a row of the wide table with a mix of column types.
+type wideRow struct {
+	I1 int64   `db:"i1"`
+	I2 int64   `db:"i2"`
+	I3 int64   `db:"i3"`
+	I4 int64   `db:"i4"`
+	I5 int64   `db:"i5"`
+	I6 int64   `db:"i6"`
+	R1 float64 `db:"r1"`
+	R2 float64 `db:"r2"`
+	R3 float64 `db:"r3"`
+	R4 float64 `db:"r4"`
+	T1 string  `db:"t1"`
+	T2 string  `db:"t2"`
+	T3 string  `db:"t3"`
+	T4 string  `db:"t4"`
+	T5 string  `db:"t5"`
+	T6 string  `db:"t6"`
+}
+
+var wideColumns = []string{"i1", "i2", "i3", "i4", "i5", "i6", "r1", "r2", "r3", "r4", "t1", "t2", "t3", "t4", "t5", "t6"}
+
+func (w *wideRow) fields() []any {
+	return []any{&w.I1, &w.I2, &w.I3, &w.I4, &w.I5, &w.I6, &w.R1, &w.R2, &w.R3, &w.R4, &w.T1, &w.T2, &w.T3, &w.T4, &w.T5, &w.T6}
+}
+
+// setupWide creates the wide table with n rows.
+func setupWide(db *sql.DB, n int) error {
+	_, err := db.Exec(`
+		create table wide (
+			id integer primary key,
+			i1 integer, i2 integer, i3 integer, i4 integer, i5 integer, i6 integer,
+			r1 real, r2 real, r3 real, r4 real,
+			t1 text, t2 text, t3 text, t4 text, t5 text, t6 text
+		)`)
+	if err != nil {
+		return err
+	}
+	return insertSeries(db, `
+		insert into wide (i1, i2, i3, i4, i5, i6, r1, r2, r3, r4, t1, t2, t3, t4, t5, t6)
+		select value, value * 2, value * 3, value * 4, value * 5, value * 6,
+			value / 2.0, value / 3.0, value / 4.0, value / 5.0,
+			?2, ?2, ?2, ?2, ?2, ?2
+		from series`, n, strings.Repeat("A", 20))
+}
+
+// BenchmarkScanWideRow compares generic ways of reading a 16-column row with
+// scanning it into a typed struct. One op reads one row.
+//   - struct: Scan into the fields of a wideRow.
+//   - slice: Scan into a positional []any of *any, as a generic layer
+//     that doesn't know the types would.
+//   - map: like slice, then build a map[string]any keyed by rows.Columns.
+func BenchmarkScanWideRow(b *testing.B) {
+	const rows = 1000
+	db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+	noErr(b, setupWide(db, rows))
+	query := fmt.Sprintf(`select %s from wide`, strings.Join(wideColumns, ", "))
+	for _, method := range []string{"struct", "slice", "map"} {
+		b.Run(fmt.Sprintf("method=%s", method), func(b *testing.B) {
+			var scan func(*sql.Rows) error
+			switch method {
+			case "struct":
+				scan = func(r *sql.Rows) error {
+					var w wideRow
+					return r.Scan(w.fields()...)
+				}
+			case "slice":
+				scan = func(r *sql.Rows) error {
+					_, err := scanSlice(r, len(wideColumns))
+					return err
+				}
+			case "map":
+				scan = func(r *sql.Rows) error {
+					_, err := scanMap(r)
+					return err
+				}
+			}
+			b.ReportAllocs()
+			benchScanRows(b, db, query, rows, scan)
+		})
+	}
+}
+
+func scanSlice(r *sql.Rows, n int) ([]any, error) {
+	values := make([]any, n)
+	dest := make([]any, n)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	return values, r.Scan(dest...)
+}
+
+func scanMap(r *sql.Rows) (map[string]any, error) {
+	columns, err := r.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values, err := scanSlice(r, len(columns))
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]any, len(columns))
+	for i, column := range columns {
+		m[column] = values[i]
+	}
+	return m, nil
+}
+
+// structFields caches the field index of every db tag for each struct type.
+var structFields sync.Map // reflect.Type -> map[string]int
+
+// scanInto scans the current row into the struct dst points to, matching
+// columns to fields by their db tag, like the mappers of small ORMs do.
+func scanInto(rows *sql.Rows, dst any) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("scanInto: want a pointer to a struct, got %T", dst)
+	}
+	v = v.Elem()
+	fields, ok := structFields.Load(v.Type())
+	if !ok {
+		m := make(map[string]int)
+		for i := 0; i < v.NumField(); i++ {
+			if tag := v.Type().Field(i).Tag.Get("db"); tag != "" {
+				m[tag] = i
+			}
+		}
+		fields, _ = structFields.LoadOrStore(v.Type(), m)
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	dest := make([]any, len(columns))
+	for i, column := range columns {
+		field, ok := fields.(map[string]int)[column]
+		if !ok {
+			return fmt.Errorf("scanInto: no field for column %q in %T", column, dst)
+		}
+		dest[i] = v.Field(field).Addr().Interface()
+	}
+	return rows.Scan(dest...)
+}
+
+// BenchmarkScanIntoReflection compares scanInto with a hand-written Scan
+// into the same struct as the number of selected columns grows. One op reads
+// one row.
+func BenchmarkScanIntoReflection(b *testing.B) {
+	const rows = 1000
+	db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+	noErr(b, setupWide(db, rows))
+	for _, n := range []int{4, 8, 16} {
+		query := fmt.Sprintf(`select %s from wide`, strings.Join(wideColumns[:n], ", "))
+		for _, method := range []string{"scan", "reflect"} {
+			b.Run(fmt.Sprintf("columns=%d&method=%s", n, method), func(b *testing.B) {
+				b.ReportAllocs()
+				benchScanRows(b, db, query, rows, func(r *sql.Rows) error {
+					var w wideRow
+					if method == "reflect" {
+						return scanInto(r, &w)
+					}
+					return r.Scan(w.fields()[:n]...)
+				})
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/column")
+			})
+		}
+	}
+}
+
+func TestScanInto(t *testing.T) {
+	db := makeDB(t, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+	noErr(t, setupWide(db, 2))
+	rows, err := db.Query(`select t1, i2, r1 from wide where id = 2`)
+	noErr(t, err)
+	defer rows.Close()
+	if !rows.Next() {
+		t.Fatal("no rows")
+	}
+	var w wideRow
+	noErr(t, scanInto(rows, &w))
+	if want := (wideRow{I2: 4, R1: 1, T1: strings.Repeat("A", 20)}); w != want {
+		t.Errorf("got %+v, want %+v", w, want)
+	}
+	if err := scanInto(rows, w); err == nil {
+		t.Error("scanInto into a struct value succeeded")
+	}
+
+	rows, err = db.Query(`select id from wide`)
+	noErr(t, err)
+	defer rows.Close()
+	rows.Next()
+	if err := scanInto(rows, &w); err == nil {
+		t.Error("scanInto with an unmapped column succeeded")
+	}
+}
+
+// nullableWideRow is wideRow with every column nullable.
+type nullableWideRow struct {
+	I1, I2, I3, I4, I5, I6 sql.NullInt64
+	R1, R2, R3, R4         sql.NullFloat64
+	T1, T2, T3, T4, T5, T6 sql.NullString
+}
+
+func (w *nullableWideRow) fields() []any {
+	return []any{&w.I1, &w.I2, &w.I3, &w.I4, &w.I5, &w.I6, &w.R1, &w.R2, &w.R3, &w.R4, &w.T1, &w.T2, &w.T3, &w.T4, &w.T5, &w.T6}
+}
+
+// BenchmarkScanSparseWideRow scans 16-column rows into sql.Null* fields.
+// density=sparse has only i1, r1 and t1 set and the other 13 columns NULL,
+// density=dense has all columns set. dense-plain scans the dense row into
+// plain types for reference. One op reads one row.
+func BenchmarkScanSparseWideRow(b *testing.B) {
+	const rows = 1000
+	db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+	noErr(b, setupWide(db, rows))
+	_, err := db.Exec(`
+		create table sparse as select * from wide;
+		update sparse set i2 = null, i3 = null, i4 = null, i5 = null, i6 = null,
+			r2 = null, r3 = null, r4 = null,
+			t2 = null, t3 = null, t4 = null, t5 = null, t6 = null`)
+	noErr(b, err)
+	columns := strings.Join(wideColumns, ", ")
+	for _, density := range []string{"dense-plain", "dense", "sparse"} {
+		b.Run(fmt.Sprintf("density=%s", density), func(b *testing.B) {
+			query := fmt.Sprintf(`select %s from wide`, columns)
+			if density == "sparse" {
+				query = fmt.Sprintf(`select %s from sparse`, columns)
+			}
+			b.ReportAllocs()
+			benchScanRows(b, db, query, rows, func(r *sql.Rows) error {
+				if density == "dense-plain" {
+					var w wideRow
+					return r.Scan(w.fields()...)
+				}
+				var w nullableWideRow
+				return r.Scan(w.fields()...)
+			})
+		})
+	}
+}
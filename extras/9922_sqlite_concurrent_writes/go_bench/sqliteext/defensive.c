@@ -0,0 +1,35 @@
+// An auto-extension that adds a defensive(on) SQL function to every new
+// connection. Calling it sets SQLITE_DBCONFIG_DEFENSIVE on the connection
+// with sqlite3_db_config and returns the flag's new value. In defensive
+// mode, SQLite refuses writes to sqlite_schema even with writable_schema=on,
+// direct writes to the shadow tables of virtual tables, and other ways to
+// corrupt the database with SQL alone.
+
+#include <stddef.h>
+
+#include "defensive.h"
+#include "sqlite3func.h"
+
+#define SQLITE_DBCONFIG_DEFENSIVE 1010
+
+static void defensiveFunc(sqlite3_context *ctx, int argc, sqlite3_value **argv) {
+  sqlite3 *db = sqlite3_context_db_handle(ctx);
+  int on = sqlite3_value_int64(argv[0]) != 0;
+  int result = -1;
+  int rc = sqlite3_db_config(db, SQLITE_DBCONFIG_DEFENSIVE, on, &result);
+  if (rc != SQLITE_OK) {
+    sqlite3_result_error_code(ctx, rc);
+    return;
+  }
+  sqlite3_result_int64(ctx, result);
+}
+
+static int defensiveInit(sqlite3 *db, char **errMsg, const void *api) {
+  // Only a statement the application runs can change the flag, not a view
+  // or trigger in the schema it's meant to protect against.
+  return sqlite3_create_function_v2(db, "defensive", 1, SQLITE_UTF8 | SQLITE_DIRECTONLY, NULL, defensiveFunc, NULL, NULL, NULL);
+}
+
+int defensive_register(void) {
+  return sqlite3_auto_extension((void (*)(void))defensiveInit);
+}
@@ -0,0 +1,30 @@
+package sqliteext
+
+/*
+#include "defensive.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+)
+
+var registerDefensiveOnce = sync.OnceValue(func() error {
+	if err := checkImports(); err != nil {
+		return err
+	}
+	if rc := C.defensive_register(); rc != 0 {
+		return fmt.Errorf("registering defensive: sqlite error %d", rc)
+	}
+	return nil
+})
+
+// RegisterDefensive adds a defensive(on) SQL function to every connection
+// opened after it's called. go-sqlite3 doesn't expose sqlite3_db_config, so
+// select defensive(1) is how a connection turns on SQLITE_DBCONFIG_DEFENSIVE
+// for itself, e.g. from a ConnectHook. It returns the flag's new value. The
+// function can't be called from views or triggers.
+func RegisterDefensive() error {
+	return registerDefensiveOnce()
+}
@@ -0,0 +1,6 @@
+#ifndef SQLITE_BENCH_DEFENSIVE_H
+#define SQLITE_BENCH_DEFENSIVE_H
+
+int defensive_register(void);
+
+#endif
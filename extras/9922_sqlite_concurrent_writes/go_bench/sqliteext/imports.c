@@ -0,0 +1,38 @@
+#include <stddef.h>
+
+#include "imports.h"
+#include "sqlite3func.h"
+#include "sqlite3vfs.h"
+
+#define IMPORT(f) {#f, (void (*)(void))f}
+
+static const struct {
+  const char *name;
+  void (*addr)(void);
+} imports[] = {
+  IMPORT(sqlite3_vfs_find),
+  IMPORT(sqlite3_vfs_register),
+  IMPORT(sqlite3_auto_extension),
+  IMPORT(sqlite3_create_function_v2),
+  IMPORT(sqlite3_user_data),
+  IMPORT(sqlite3_context_db_handle),
+  IMPORT(sqlite3_value_int64),
+  IMPORT(sqlite3_result_int64),
+  IMPORT(sqlite3_result_error_code),
+  IMPORT(sqlite3_db_config),
+  IMPORT(sqlite3_progress_handler),
+  IMPORT(sqlite3_trace_v2),
+  IMPORT(sqlite3_malloc),
+  IMPORT(sqlite3_free),
+};
+
+// sqliteext_missing_import returns the name of the first imported function
+// that isn't defined in the binary, or NULL if they all are.
+const char *sqliteext_missing_import(void) {
+  for (size_t i = 0; i < sizeof(imports) / sizeof(imports[0]); i++) {
+    if (imports[i].addr == NULL) {
+      return imports[i].name;
+    }
+  }
+  return NULL;
+}
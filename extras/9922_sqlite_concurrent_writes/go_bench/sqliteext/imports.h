@@ -0,0 +1,22 @@
+// The SQLite functions called by the C code in this package are defined by
+// github.com/mattn/go-sqlite3, which is only linked together with it in the
+// final binary. cgo also links each package on its own, to find the symbols
+// it imports, so on ELF platforms they are declared with SQLITE_BENCH_IMPORT,
+// which makes them weak. That link leaves them at 0 instead of failing, and
+// the final link binds them to go-sqlite3's definitions. Only the functions
+// declared this way may be left undefined, and every one of them must be
+// listed in imports.c, so that one the binary doesn't define is reported
+// by name when a shim is registered instead of crashing when it's called.
+
+#ifndef SQLITE_BENCH_IMPORTS_H
+#define SQLITE_BENCH_IMPORTS_H
+
+#if defined(__ELF__)
+#define SQLITE_BENCH_IMPORT __attribute__((weak))
+#else
+#define SQLITE_BENCH_IMPORT
+#endif
+
+const char *sqliteext_missing_import(void);
+
+#endif
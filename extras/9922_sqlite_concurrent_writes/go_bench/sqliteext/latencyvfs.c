@@ -0,0 +1,153 @@
+// A VFS shim that wraps the default VFS and sleeps before every read, write
+// and sync. Shared memory (-shm) access is not delayed.
+
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+
+#include "sqlite3vfs.h"
+#include "latencyvfs.h"
+
+static int latency_us;
+
+typedef struct latency_file {
+  sqlite3_file base;
+  sqlite3_file *real;
+} latency_file;
+
+static void latency_sleep(void) {
+  int us = __atomic_load_n(&latency_us, __ATOMIC_RELAXED);
+  if (us > 0) {
+    usleep(us);
+  }
+}
+
+#define REAL(f) (((latency_file*)(f))->real)
+
+static int latencyClose(sqlite3_file *f) {
+  return REAL(f)->pMethods->xClose(REAL(f));
+}
+
+static int latencyRead(sqlite3_file *f, void *buf, int n, sqlite3_int64 off) {
+  latency_sleep();
+  return REAL(f)->pMethods->xRead(REAL(f), buf, n, off);
+}
+
+static int latencyWrite(sqlite3_file *f, const void *buf, int n, sqlite3_int64 off) {
+  latency_sleep();
+  return REAL(f)->pMethods->xWrite(REAL(f), buf, n, off);
+}
+
+static int latencyTruncate(sqlite3_file *f, sqlite3_int64 size) {
+  return REAL(f)->pMethods->xTruncate(REAL(f), size);
+}
+
+static int latencySync(sqlite3_file *f, int flags) {
+  latency_sleep();
+  return REAL(f)->pMethods->xSync(REAL(f), flags);
+}
+
+static int latencyFileSize(sqlite3_file *f, sqlite3_int64 *size) {
+  return REAL(f)->pMethods->xFileSize(REAL(f), size);
+}
+
+static int latencyLock(sqlite3_file *f, int lock) {
+  return REAL(f)->pMethods->xLock(REAL(f), lock);
+}
+
+static int latencyUnlock(sqlite3_file *f, int lock) {
+  return REAL(f)->pMethods->xUnlock(REAL(f), lock);
+}
+
+static int latencyCheckReservedLock(sqlite3_file *f, int *out) {
+  return REAL(f)->pMethods->xCheckReservedLock(REAL(f), out);
+}
+
+static int latencyFileControl(sqlite3_file *f, int op, void *arg) {
+  return REAL(f)->pMethods->xFileControl(REAL(f), op, arg);
+}
+
+static int latencySectorSize(sqlite3_file *f) {
+  return REAL(f)->pMethods->xSectorSize(REAL(f));
+}
+
+static int latencyDeviceCharacteristics(sqlite3_file *f) {
+  return REAL(f)->pMethods->xDeviceCharacteristics(REAL(f));
+}
+
+static int latencyShmMap(sqlite3_file *f, int pg, int pgsz, int extend, void volatile **pp) {
+  return REAL(f)->pMethods->xShmMap(REAL(f), pg, pgsz, extend, pp);
+}
+
+static int latencyShmLock(sqlite3_file *f, int offset, int n, int flags) {
+  return REAL(f)->pMethods->xShmLock(REAL(f), offset, n, flags);
+}
+
+static void latencyShmBarrier(sqlite3_file *f) {
+  REAL(f)->pMethods->xShmBarrier(REAL(f));
+}
+
+static int latencyShmUnmap(sqlite3_file *f, int deleteFlag) {
+  return REAL(f)->pMethods->xShmUnmap(REAL(f), deleteFlag);
+}
+
+static int latencyFetch(sqlite3_file *f, sqlite3_int64 off, int n, void **pp) {
+  return REAL(f)->pMethods->xFetch(REAL(f), off, n, pp);
+}
+
+static int latencyUnfetch(sqlite3_file *f, sqlite3_int64 off, void *p) {
+  return REAL(f)->pMethods->xUnfetch(REAL(f), off, p);
+}
+
+static const sqlite3_io_methods latency_io_methods = {
+  3,
+  latencyClose,
+  latencyRead,
+  latencyWrite,
+  latencyTruncate,
+  latencySync,
+  latencyFileSize,
+  latencyLock,
+  latencyUnlock,
+  latencyCheckReservedLock,
+  latencyFileControl,
+  latencySectorSize,
+  latencyDeviceCharacteristics,
+  latencyShmMap,
+  latencyShmLock,
+  latencyShmBarrier,
+  latencyShmUnmap,
+  latencyFetch,
+  latencyUnfetch,
+};
+
+static sqlite3_vfs latency_vfs;
+static sqlite3_vfs *real_vfs;
+
+static int latencyOpen(sqlite3_vfs *vfs, sqlite3_filename name, sqlite3_file *f, int flags, int *outFlags) {
+  latency_file *lf = (latency_file*)f;
+  lf->real = (sqlite3_file*)&lf[1];
+  int rc = real_vfs->xOpen(real_vfs, name, lf->real, flags, outFlags);
+  // SQLite calls xClose only if pMethods is set, so leave it NULL on failure.
+  lf->base.pMethods = lf->real->pMethods ? &latency_io_methods : NULL;
+  return rc;
+}
+
+int latency_vfs_register(void) {
+  real_vfs = sqlite3_vfs_find(NULL);
+  if (real_vfs == NULL) {
+    return SQLITE_IOERR;
+  }
+  // Other methods work with the real VFS's state in pAppData, so they can be
+  // used as is with the shim's sqlite3_vfs.
+  latency_vfs = *real_vfs;
+  latency_vfs.zName = "latency";
+  latency_vfs.pNext = NULL;
+  latency_vfs.szOsFile = sizeof(latency_file) + real_vfs->szOsFile;
+  latency_vfs.xOpen = latencyOpen;
+  return sqlite3_vfs_register(&latency_vfs, 0);
+}
+
+void latency_vfs_set(int us) {
+  __atomic_store_n(&latency_us, us, __ATOMIC_RELAXED);
+}
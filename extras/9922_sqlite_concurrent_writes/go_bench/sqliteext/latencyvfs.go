@@ -0,0 +1,36 @@
+package sqliteext
+
+/*
+#include "latencyvfs.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var registerLatencyVFSOnce = sync.OnceValue(func() error {
+	if err := checkImports(); err != nil {
+		return err
+	}
+	if rc := C.latency_vfs_register(); rc != 0 {
+		return fmt.Errorf("registering latency vfs: sqlite error %d", rc)
+	}
+	return nil
+})
+
+// RegisterLatencyVFS registers the "latency" VFS, selected with ?vfs=latency.
+// It wraps the default VFS and sleeps before every read, write and sync
+// of the database, journal and WAL files, which simulates a slow disk.
+// The delay is 0 until set with SetVFSLatency.
+func RegisterLatencyVFS() error {
+	return registerLatencyVFSOnce()
+}
+
+// SetVFSLatency sets the delay injected per I/O by the latency VFS.
+// It applies to all connections using the VFS.
+func SetVFSLatency(d time.Duration) {
+	C.latency_vfs_set(C.int(d.Microseconds()))
+}
@@ -0,0 +1,7 @@
+#ifndef SQLITE_BENCH_LATENCYVFS_H
+#define SQLITE_BENCH_LATENCYVFS_H
+
+int latency_vfs_register(void);
+void latency_vfs_set(int us);
+
+#endif
@@ -0,0 +1,36 @@
+// The subset of sqlite3.h needed to add SQL functions and hooks to a
+// connection. The SQLite library itself is compiled and linked in by
+// github.com/mattn/go-sqlite3, see imports.h.
+
+#ifndef SQLITE_BENCH_SQLITE3FUNC_H
+#define SQLITE_BENCH_SQLITE3FUNC_H
+
+// For the result codes and sqlite3_int64.
+#include "sqlite3vfs.h"
+
+typedef struct sqlite3 sqlite3;
+typedef struct sqlite3_context sqlite3_context;
+typedef struct sqlite3_value sqlite3_value;
+
+#define SQLITE_UTF8 1
+#define SQLITE_DIRECTONLY 0x000080000
+#define SQLITE_TRACE_STMT 0x01
+
+SQLITE_BENCH_IMPORT int sqlite3_auto_extension(void (*xEntryPoint)(void));
+SQLITE_BENCH_IMPORT int sqlite3_create_function_v2(sqlite3 *db, const char *zFunctionName, int nArg, int eTextRep, void *pApp,
+    void (*xFunc)(sqlite3_context*, int, sqlite3_value**),
+    void (*xStep)(sqlite3_context*, int, sqlite3_value**),
+    void (*xFinal)(sqlite3_context*),
+    void (*xDestroy)(void*));
+SQLITE_BENCH_IMPORT void *sqlite3_user_data(sqlite3_context*);
+SQLITE_BENCH_IMPORT sqlite3 *sqlite3_context_db_handle(sqlite3_context*);
+SQLITE_BENCH_IMPORT sqlite3_int64 sqlite3_value_int64(sqlite3_value*);
+SQLITE_BENCH_IMPORT void sqlite3_result_int64(sqlite3_context*, sqlite3_int64);
+SQLITE_BENCH_IMPORT void sqlite3_result_error_code(sqlite3_context*, int);
+SQLITE_BENCH_IMPORT int sqlite3_db_config(sqlite3*, int op, ...);
+SQLITE_BENCH_IMPORT void sqlite3_progress_handler(sqlite3*, int, int (*)(void*), void*);
+SQLITE_BENCH_IMPORT int sqlite3_trace_v2(sqlite3*, unsigned uMask, int (*xCallback)(unsigned, void*, void*, void*), void *pCtx);
+SQLITE_BENCH_IMPORT void *sqlite3_malloc(int);
+SQLITE_BENCH_IMPORT void sqlite3_free(void*);
+
+#endif
@@ -0,0 +1,32 @@
+// Package sqliteext has C extensions to the SQLite library that
+// github.com/mattn/go-sqlite3 compiles in: VFS shims and SQL functions the
+// benchmarks register with it. imports.h explains how the C code links
+// against go-sqlite3's SQLite.
+package sqliteext
+
+/*
+// On macOS, cgo only allows leaving undefined symbols to dynamic lookup all
+// at once, not one by one, and the flag also applies to the final link.
+// The ELF builds check the imports instead, see imports.h.
+#cgo darwin LDFLAGS: -Wl,-undefined,dynamic_lookup
+
+#include "imports.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+
+	// The SQLite functions used by the C code are provided by go-sqlite3.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// checkImports returns an error naming the first SQLite function used by
+// the C code that isn't linked into the binary.
+var checkImports = sync.OnceValue(func() error {
+	if name := C.sqliteext_missing_import(); name != nil {
+		return fmt.Errorf("SQLite function %s is not linked in", C.GoString(name))
+	}
+	return nil
+})
@@ -0,0 +1,68 @@
+// An auto-extension that adds a step_budget(steps) SQL function to every
+// new connection. Calling it installs a progress handler on the connection
+// that interrupts any statement running more than steps VM instructions,
+// counted in periods of STEP_BUDGET_PERIOD. The count starts over with each
+// statement, which the handler learns about from an SQLITE_TRACE_STMT trace
+// callback. step_budget(0) removes the handler and the trace callback.
+
+#include <stddef.h>
+
+#include "sqlite3func.h"
+#include "stepbudget.h"
+
+#define STEP_BUDGET_PERIOD 1000
+
+typedef struct step_budget {
+  sqlite3_int64 periods;
+  sqlite3_int64 left;
+} step_budget;
+
+static int budgetProgress(void *arg) {
+  step_budget *b = arg;
+  return --b->left < 0;
+}
+
+static int budgetTrace(unsigned type, void *arg, void *stmt, void *sql) {
+  // Trigger programs are traced too, with their SQL starting with "--".
+  // They run as part of the statement that fired them and share its budget.
+  const char *s = sql;
+  if (s[0] != '-' || s[1] != '-') {
+    step_budget *b = arg;
+    b->left = b->periods;
+  }
+  return 0;
+}
+
+static void stepBudgetFunc(sqlite3_context *ctx, int argc, sqlite3_value **argv) {
+  step_budget *b = sqlite3_user_data(ctx);
+  sqlite3 *db = sqlite3_context_db_handle(ctx);
+  sqlite3_int64 steps = sqlite3_value_int64(argv[0]);
+  if (steps <= 0) {
+    sqlite3_progress_handler(db, 0, NULL, NULL);
+    sqlite3_trace_v2(db, 0, NULL, NULL);
+    b->periods = 0;
+  } else {
+    b->periods = (steps + STEP_BUDGET_PERIOD - 1) / STEP_BUDGET_PERIOD;
+    sqlite3_progress_handler(db, STEP_BUDGET_PERIOD, budgetProgress, b);
+    sqlite3_trace_v2(db, SQLITE_TRACE_STMT, budgetTrace, b);
+  }
+  // The statement calling step_budget was traced before the handler was
+  // installed, so its own steps don't count.
+  b->left = b->periods;
+  sqlite3_result_int64(ctx, b->periods * STEP_BUDGET_PERIOD);
+}
+
+static int stepBudgetInit(sqlite3 *db, char **errMsg, const void *api) {
+  step_budget *b = sqlite3_malloc(sizeof(step_budget));
+  if (b == NULL) {
+    return SQLITE_NOMEM;
+  }
+  b->periods = 0;
+  b->left = 0;
+  // The budget is freed with the function when the connection is closed.
+  return sqlite3_create_function_v2(db, "step_budget", 1, SQLITE_UTF8, b, stepBudgetFunc, NULL, NULL, sqlite3_free);
+}
+
+int step_budget_register(void) {
+  return sqlite3_auto_extension((void (*)(void))stepBudgetInit);
+}
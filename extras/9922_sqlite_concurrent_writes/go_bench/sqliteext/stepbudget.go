@@ -0,0 +1,33 @@
+package sqliteext
+
+/*
+#include "stepbudget.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+)
+
+var registerStepBudgetOnce = sync.OnceValue(func() error {
+	if err := checkImports(); err != nil {
+		return err
+	}
+	if rc := C.step_budget_register(); rc != 0 {
+		return fmt.Errorf("registering step_budget: sqlite error %d", rc)
+	}
+	return nil
+})
+
+// RegisterStepBudget adds a step_budget(steps) SQL function to every
+// connection opened after it's called. go-sqlite3 doesn't expose
+// sqlite3_progress_handler, so it's installed by calling the function:
+// after select step_budget(n), every statement on the connection that runs
+// more than about n VM instructions fails with SQLITE_INTERRUPT. The budget
+// is rounded up to a multiple of 1000, how often the handler is called.
+// select step_budget(0) removes it. Connections that never call it don't
+// run a handler.
+func RegisterStepBudget() error {
+	return registerStepBudgetOnce()
+}
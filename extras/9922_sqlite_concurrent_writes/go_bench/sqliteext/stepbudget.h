@@ -0,0 +1,6 @@
+#ifndef SQLITE_BENCH_STEPBUDGET_H
+#define SQLITE_BENCH_STEPBUDGET_H
+
+int step_budget_register(void);
+
+#endif
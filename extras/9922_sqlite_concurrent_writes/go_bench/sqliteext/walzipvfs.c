@@ -0,0 +1,471 @@
+//go:build walzip
+
+// A VFS shim that wraps the default VFS and stores the WAL zlib-compressed.
+// Other files are opened with the default VFS as is.
+//
+// The WAL file on disk is an append-only log of records, one per xWrite: a
+// header with the logical offset, the uncompressed and the stored length,
+// followed by the data. The data is stored uncompressed if compressing it
+// doesn't make it smaller. An index of which record holds the latest bytes
+// of each logical range is kept in memory and rebuilt from the records when
+// the WAL is first opened, e.g. for recovery after a crash. A write at
+// offset 0, which SQLite does when it restarts the WAL, or a truncate to 0
+// empties the file.
+//
+// The index is shared between the connections of one process, so the WAL
+// must not be used by several processes. Truncating the WAL to a size
+// other than 0 is not persisted.
+
+#include <pthread.h>
+#include <stdlib.h>
+#include <string.h>
+#include <zlib.h>
+
+#include "sqlite3vfs.h"
+#include "walzipvfs.h"
+
+typedef struct record_header {
+  sqlite3_int64 off;
+  unsigned int ulen;
+  unsigned int slen;
+} record_header;
+
+// A segment is a logical range [off, off+len) whose latest bytes are in
+// the record at rec, starting skip bytes into its uncompressed data.
+typedef struct segment {
+  sqlite3_int64 off;
+  sqlite3_int64 rec;
+  int len;
+  int skip;
+} segment;
+
+typedef struct walzip_wal {
+  struct walzip_wal *next;
+  char *path;
+  int refs;
+  pthread_mutex_t mu;
+  segment *segs;
+  int nsegs;
+  int cap;
+  sqlite3_int64 size;
+  sqlite3_int64 end;
+  // The uncompressed data of the record last read, since SQLite reads a
+  // frame header and then the page behind it.
+  sqlite3_int64 cached;
+  unsigned char *cache;
+  int cacheCap;
+} walzip_wal;
+
+typedef struct walzip_file {
+  sqlite3_file base;
+  sqlite3_file *real;
+  walzip_wal *wal;
+} walzip_file;
+
+static pthread_mutex_t wals_mu = PTHREAD_MUTEX_INITIALIZER;
+static walzip_wal *wals;
+
+static sqlite3_int64 logical_bytes;
+static sqlite3_int64 physical_bytes;
+
+#define REAL(f) (((walzip_file*)(f))->real)
+#define WAL(f) (((walzip_file*)(f))->wal)
+
+// first returns the index of the first segment that ends after off.
+static int first(walzip_wal *w, sqlite3_int64 off) {
+  int lo = 0, hi = w->nsegs;
+  while (lo < hi) {
+    int mid = (lo + hi) / 2;
+    if (w->segs[mid].off + w->segs[mid].len <= off) {
+      lo = mid + 1;
+    } else {
+      hi = mid;
+    }
+  }
+  return lo;
+}
+
+// replace makes [off, off+len) point to the record at rec, trimming or
+// splitting the segments it overlaps.
+static int replace(walzip_wal *w, sqlite3_int64 off, int len, sqlite3_int64 rec) {
+  sqlite3_int64 end = off + len;
+  int i = first(w, off);
+  int j = i;
+  while (j < w->nsegs && w->segs[j].off < end) {
+    j++;
+  }
+  segment add[3];
+  int n = 0;
+  if (i < j && w->segs[i].off < off) {
+    add[n] = w->segs[i];
+    add[n].len = off - w->segs[i].off;
+    n++;
+  }
+  add[n++] = (segment){off, rec, len, 0};
+  if (i < j && w->segs[j-1].off + w->segs[j-1].len > end) {
+    segment last = w->segs[j-1];
+    add[n] = last;
+    add[n].off = end;
+    add[n].skip = last.skip + (end - last.off);
+    add[n].len = last.off + last.len - end;
+    n++;
+  }
+  int nsegs = w->nsegs - (j - i) + n;
+  if (nsegs > w->cap) {
+    int cap = w->cap ? w->cap * 2 : 64;
+    while (cap < nsegs) {
+      cap *= 2;
+    }
+    segment *segs = realloc(w->segs, cap * sizeof(segment));
+    if (segs == NULL) {
+      return SQLITE_NOMEM;
+    }
+    w->segs = segs;
+    w->cap = cap;
+  }
+  memmove(&w->segs[i+n], &w->segs[j], (w->nsegs - j) * sizeof(segment));
+  memcpy(&w->segs[i], add, n * sizeof(segment));
+  w->nsegs = nsegs;
+  if (end > w->size) {
+    w->size = end;
+  }
+  return SQLITE_OK;
+}
+
+static int reset(walzip_wal *w, sqlite3_file *real) {
+  w->nsegs = 0;
+  w->size = 0;
+  w->end = 0;
+  w->cached = -1;
+  return real->pMethods->xTruncate(real, 0);
+}
+
+// load reads and uncompresses the record at rec into the cache.
+static int load(walzip_wal *w, sqlite3_file *real, sqlite3_int64 rec) {
+  if (w->cached == rec) {
+    return SQLITE_OK;
+  }
+  record_header h;
+  int rc = real->pMethods->xRead(real, &h, sizeof(h), rec);
+  if (rc != SQLITE_OK) {
+    return rc;
+  }
+  if ((int)h.ulen > w->cacheCap) {
+    unsigned char *cache = realloc(w->cache, h.ulen);
+    if (cache == NULL) {
+      return SQLITE_NOMEM;
+    }
+    w->cache = cache;
+    w->cacheCap = h.ulen;
+  }
+  w->cached = -1;
+  if (h.slen == h.ulen) {
+    rc = real->pMethods->xRead(real, w->cache, h.ulen, rec + sizeof(h));
+  } else {
+    unsigned char *data = malloc(h.slen);
+    if (data == NULL) {
+      return SQLITE_NOMEM;
+    }
+    rc = real->pMethods->xRead(real, data, h.slen, rec + sizeof(h));
+    uLongf ulen = h.ulen;
+    if (rc == SQLITE_OK && (uncompress(w->cache, &ulen, data, h.slen) != Z_OK || ulen != h.ulen)) {
+      rc = SQLITE_IOERR;
+    }
+    free(data);
+  }
+  if (rc == SQLITE_OK) {
+    w->cached = rec;
+  }
+  return rc;
+}
+
+// scan rebuilds the index from the records in the file. A record cut
+// short by a crash ends the log and is overwritten by the next write.
+static int scan(walzip_wal *w, sqlite3_file *real) {
+  sqlite3_int64 size;
+  int rc = real->pMethods->xFileSize(real, &size);
+  if (rc != SQLITE_OK) {
+    return rc;
+  }
+  while (w->end + (sqlite3_int64)sizeof(record_header) <= size) {
+    record_header h;
+    rc = real->pMethods->xRead(real, &h, sizeof(h), w->end);
+    if (rc != SQLITE_OK) {
+      return rc;
+    }
+    sqlite3_int64 next = w->end + sizeof(h) + h.slen;
+    if (next > size) {
+      break;
+    }
+    rc = replace(w, h.off, h.ulen, w->end);
+    if (rc != SQLITE_OK) {
+      return rc;
+    }
+    w->end = next;
+  }
+  return SQLITE_OK;
+}
+
+static void release(walzip_wal *w) {
+  pthread_mutex_lock(&wals_mu);
+  if (--w->refs == 0) {
+    walzip_wal **p = &wals;
+    while (*p != w) {
+      p = &(*p)->next;
+    }
+    *p = w->next;
+    pthread_mutex_destroy(&w->mu);
+    free(w->segs);
+    free(w->cache);
+    free(w->path);
+    free(w);
+  }
+  pthread_mutex_unlock(&wals_mu);
+}
+
+// acquire returns the shared index of the WAL at path, creating it from
+// the file's records if no other connection has it open.
+static int acquire(const char *path, sqlite3_file *real, walzip_wal **out) {
+  int rc = SQLITE_OK;
+  pthread_mutex_lock(&wals_mu);
+  walzip_wal *w = wals;
+  while (w != NULL && strcmp(w->path, path) != 0) {
+    w = w->next;
+  }
+  if (w == NULL) {
+    w = calloc(1, sizeof(walzip_wal));
+    if (w == NULL || (w->path = strdup(path)) == NULL) {
+      free(w);
+      pthread_mutex_unlock(&wals_mu);
+      return SQLITE_NOMEM;
+    }
+    pthread_mutex_init(&w->mu, NULL);
+    w->cached = -1;
+    rc = scan(w, real);
+    w->next = wals;
+    wals = w;
+  }
+  w->refs++;
+  pthread_mutex_unlock(&wals_mu);
+  if (rc != SQLITE_OK) {
+    release(w);
+    return rc;
+  }
+  *out = w;
+  return SQLITE_OK;
+}
+
+static int walzipClose(sqlite3_file *f) {
+  release(WAL(f));
+  return REAL(f)->pMethods->xClose(REAL(f));
+}
+
+static int walzipRead(sqlite3_file *f, void *buf, int n, sqlite3_int64 off) {
+  walzip_wal *w = WAL(f);
+  int rc = SQLITE_OK;
+  memset(buf, 0, n);
+  pthread_mutex_lock(&w->mu);
+  sqlite3_int64 end = off + n;
+  for (int i = first(w, off); i < w->nsegs && w->segs[i].off < end && rc == SQLITE_OK; i++) {
+    segment *s = &w->segs[i];
+    rc = load(w, REAL(f), s->rec);
+    if (rc == SQLITE_OK) {
+      sqlite3_int64 from = s->off > off ? s->off : off;
+      sqlite3_int64 to = s->off + s->len < end ? s->off + s->len : end;
+      memcpy((char*)buf + (from - off), w->cache + s->skip + (from - s->off), to - from);
+    }
+  }
+  if (rc == SQLITE_OK && end > w->size) {
+    rc = SQLITE_IOERR_SHORT_READ;
+  }
+  pthread_mutex_unlock(&w->mu);
+  return rc;
+}
+
+static int walzipWrite(sqlite3_file *f, const void *buf, int n, sqlite3_int64 off) {
+  walzip_wal *w = WAL(f);
+  uLongf slen = compressBound(n);
+  unsigned char *rec = malloc(sizeof(record_header) + slen);
+  if (rec == NULL) {
+    return SQLITE_NOMEM;
+  }
+  if (compress2(rec + sizeof(record_header), &slen, buf, n, 1) != Z_OK || slen >= (uLongf)n) {
+    memcpy(rec + sizeof(record_header), buf, n);
+    slen = n;
+  }
+  record_header h = {off, n, slen};
+  memcpy(rec, &h, sizeof(h));
+
+  int rc = SQLITE_OK;
+  pthread_mutex_lock(&w->mu);
+  if (off == 0) {
+    rc = reset(w, REAL(f));
+  }
+  if (rc == SQLITE_OK) {
+    rc = REAL(f)->pMethods->xWrite(REAL(f), rec, sizeof(h) + slen, w->end);
+  }
+  if (rc == SQLITE_OK) {
+    rc = replace(w, off, n, w->end);
+  }
+  if (rc == SQLITE_OK) {
+    w->end += sizeof(h) + slen;
+    __atomic_add_fetch(&logical_bytes, n, __ATOMIC_RELAXED);
+    __atomic_add_fetch(&physical_bytes, sizeof(h) + slen, __ATOMIC_RELAXED);
+  }
+  pthread_mutex_unlock(&w->mu);
+  free(rec);
+  return rc;
+}
+
+static int walzipTruncate(sqlite3_file *f, sqlite3_int64 size) {
+  walzip_wal *w = WAL(f);
+  int rc = SQLITE_OK;
+  pthread_mutex_lock(&w->mu);
+  if (size == 0) {
+    rc = reset(w, REAL(f));
+  } else if (size < w->size) {
+    while (w->nsegs > 0 && w->segs[w->nsegs-1].off >= size) {
+      w->nsegs--;
+    }
+    if (w->nsegs > 0) {
+      segment *s = &w->segs[w->nsegs-1];
+      if (s->off + s->len > size) {
+        s->len = size - s->off;
+      }
+    }
+    w->size = size;
+  }
+  pthread_mutex_unlock(&w->mu);
+  return rc;
+}
+
+static int walzipSync(sqlite3_file *f, int flags) {
+  return REAL(f)->pMethods->xSync(REAL(f), flags);
+}
+
+static int walzipFileSize(sqlite3_file *f, sqlite3_int64 *size) {
+  walzip_wal *w = WAL(f);
+  pthread_mutex_lock(&w->mu);
+  *size = w->size;
+  pthread_mutex_unlock(&w->mu);
+  return SQLITE_OK;
+}
+
+static int walzipLock(sqlite3_file *f, int lock) {
+  return REAL(f)->pMethods->xLock(REAL(f), lock);
+}
+
+static int walzipUnlock(sqlite3_file *f, int lock) {
+  return REAL(f)->pMethods->xUnlock(REAL(f), lock);
+}
+
+static int walzipCheckReservedLock(sqlite3_file *f, int *out) {
+  return REAL(f)->pMethods->xCheckReservedLock(REAL(f), out);
+}
+
+static int walzipFileControl(sqlite3_file *f, int op, void *arg) {
+  // Size hints are in logical bytes, which would only preallocate zeros
+  // after the records.
+  if (op == SQLITE_FCNTL_SIZE_HINT || op == SQLITE_FCNTL_CHUNK_SIZE) {
+    return SQLITE_OK;
+  }
+  return REAL(f)->pMethods->xFileControl(REAL(f), op, arg);
+}
+
+static int walzipSectorSize(sqlite3_file *f) {
+  return REAL(f)->pMethods->xSectorSize(REAL(f));
+}
+
+static int walzipDeviceCharacteristics(sqlite3_file *f) {
+  return REAL(f)->pMethods->xDeviceCharacteristics(REAL(f));
+}
+
+static int walzipShmMap(sqlite3_file *f, int pg, int pgsz, int extend, void volatile **pp) {
+  return REAL(f)->pMethods->xShmMap(REAL(f), pg, pgsz, extend, pp);
+}
+
+static int walzipShmLock(sqlite3_file *f, int offset, int n, int flags) {
+  return REAL(f)->pMethods->xShmLock(REAL(f), offset, n, flags);
+}
+
+static void walzipShmBarrier(sqlite3_file *f) {
+  REAL(f)->pMethods->xShmBarrier(REAL(f));
+}
+
+static int walzipShmUnmap(sqlite3_file *f, int deleteFlag) {
+  return REAL(f)->pMethods->xShmUnmap(REAL(f), deleteFlag);
+}
+
+// The logical bytes can't be mapped, so SQLite falls back to xRead.
+static int walzipFetch(sqlite3_file *f, sqlite3_int64 off, int n, void **pp) {
+  *pp = NULL;
+  return SQLITE_OK;
+}
+
+static int walzipUnfetch(sqlite3_file *f, sqlite3_int64 off, void *p) {
+  return SQLITE_OK;
+}
+
+static const sqlite3_io_methods walzip_io_methods = {
+  3,
+  walzipClose,
+  walzipRead,
+  walzipWrite,
+  walzipTruncate,
+  walzipSync,
+  walzipFileSize,
+  walzipLock,
+  walzipUnlock,
+  walzipCheckReservedLock,
+  walzipFileControl,
+  walzipSectorSize,
+  walzipDeviceCharacteristics,
+  walzipShmMap,
+  walzipShmLock,
+  walzipShmBarrier,
+  walzipShmUnmap,
+  walzipFetch,
+  walzipUnfetch,
+};
+
+static sqlite3_vfs walzip_vfs;
+static sqlite3_vfs *real_vfs;
+
+static int walzipOpen(sqlite3_vfs *vfs, sqlite3_filename name, sqlite3_file *f, int flags, int *outFlags) {
+  if (!(flags & SQLITE_OPEN_WAL)) {
+    // The real file fits in the shim's szOsFile, so other files are opened
+    // in place and use the real VFS's methods directly.
+    return real_vfs->xOpen(real_vfs, name, f, flags, outFlags);
+  }
+  walzip_file *wf = (walzip_file*)f;
+  wf->real = (sqlite3_file*)&wf[1];
+  int rc = real_vfs->xOpen(real_vfs, name, wf->real, flags, outFlags);
+  if (rc == SQLITE_OK) {
+    rc = acquire(name, wf->real, &wf->wal);
+    if (rc != SQLITE_OK) {
+      wf->real->pMethods->xClose(wf->real);
+      wf->real->pMethods = NULL;
+    }
+  }
+  // SQLite calls xClose only if pMethods is set, so leave it NULL on failure.
+  wf->base.pMethods = wf->real->pMethods ? &walzip_io_methods : NULL;
+  return rc;
+}
+
+int walzip_vfs_register(void) {
+  real_vfs = sqlite3_vfs_find(NULL);
+  if (real_vfs == NULL) {
+    return SQLITE_IOERR;
+  }
+  walzip_vfs = *real_vfs;
+  walzip_vfs.zName = "walzip";
+  walzip_vfs.pNext = NULL;
+  walzip_vfs.szOsFile = sizeof(walzip_file) + real_vfs->szOsFile;
+  walzip_vfs.xOpen = walzipOpen;
+  return sqlite3_vfs_register(&walzip_vfs, 0);
+}
+
+void walzip_vfs_stats(long long *logical, long long *physical) {
+  *logical = __atomic_load_n(&logical_bytes, __ATOMIC_RELAXED);
+  *physical = __atomic_load_n(&physical_bytes, __ATOMIC_RELAXED);
+}
@@ -0,0 +1,42 @@
+//go:build walzip
+
+package sqliteext
+
+/*
+#cgo LDFLAGS: -lz
+
+#include "walzipvfs.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+)
+
+var registerWALZipVFSOnce = sync.OnceValue(func() error {
+	if err := checkImports(); err != nil {
+		return err
+	}
+	if rc := C.walzip_vfs_register(); rc != 0 {
+		return fmt.Errorf("registering walzip vfs: sqlite error %d", rc)
+	}
+	return nil
+})
+
+// RegisterWALZipVFS registers the "walzip" VFS, selected with ?vfs=walzip.
+// It wraps the default VFS and zlib-compresses everything written to the
+// WAL, uncompressing it again on reads. It is an experiment, built only
+// with -tags walzip, and the WAL must only be used by one process.
+func RegisterWALZipVFS() error {
+	return registerWALZipVFSOnce()
+}
+
+// WALZipStats returns the bytes SQLite wrote to WALs through the walzip VFS
+// and the bytes that were written to disk for them, including the record
+// headers, since the program started.
+func WALZipStats() (logical, physical int64) {
+	var l, p C.longlong
+	C.walzip_vfs_stats(&l, &p)
+	return int64(l), int64(p)
+}
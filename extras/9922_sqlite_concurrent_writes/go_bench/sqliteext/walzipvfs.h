@@ -0,0 +1,7 @@
+#ifndef SQLITE_BENCH_WALZIPVFS_H
+#define SQLITE_BENCH_WALZIPVFS_H
+
+int walzip_vfs_register(void);
+void walzip_vfs_stats(long long *logical, long long *physical);
+
+#endif
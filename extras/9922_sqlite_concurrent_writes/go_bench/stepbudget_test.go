@@ -0,0 +1,95 @@
+package sqlite_bench
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+	"sqlite_bench/sqliteext"
+)
+
+// countTo is a CPU-bound query that reads no pages and runs more than 10
+// VM instructions per row.
+const countTo = `
+	with recursive c(x) as (select 1 union all select x + 1 from c where x < ?)
+	select count(*) from c`
+
+func isInterrupt(err error) bool {
+	code, _, _ := describeError(err)
+	return code == int(sqlite3.ErrInterrupt)
+}
+
+func TestStepBudget(t *testing.T) {
+	noErr(t, sqliteext.RegisterStepBudget())
+	db := makeDB(t, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	var budget int
+	noErr(t, db.QueryRow(`select step_budget(100000)`).Scan(&budget))
+	if budget != 100000 {
+		t.Fatalf("got a budget of %d steps, want 100000", budget)
+	}
+
+	var n int
+	err := db.QueryRow(`
+		with recursive c(x) as (select 1 union all select x + 1 from c)
+		select count(*) from c`).Scan(&n)
+	if !isInterrupt(err) {
+		t.Fatalf("runaway query: got %v, want SQLITE_INTERRUPT", err)
+	}
+	// Every statement gets the whole budget, so queries that would exceed
+	// it together keep working, and so does the interrupted connection.
+	for i := 0; i < 10; i++ {
+		noErr(t, db.QueryRow(countTo, 1000).Scan(&n))
+	}
+	if err := db.QueryRow(countTo, 10000).Scan(&n); !isInterrupt(err) {
+		t.Errorf("query over budget: got %v, want SQLITE_INTERRUPT", err)
+	}
+	noErr(t, db.QueryRow(`select step_budget(0)`).Scan(&budget))
+	noErr(t, db.QueryRow(countTo, 10000).Scan(&n))
+	if n != 10000 {
+		t.Errorf("counted to %d, want 10000", n)
+	}
+}
+
+// BenchmarkStepBudget measures the overhead of a step budget on a point read
+// and on an aggregate over 10000 posts. With budget=on, the progress handler
+// runs every 1000 VM instructions and the trace callback once per statement.
+// The budget is high enough that no query is interrupted. Unlike a context
+// deadline, which go-sqlite3 enforces with a goroutine per query that calls
+// sqlite3_interrupt, the budget costs nothing outside of SQLite and counts
+// work rather than time, so a query is cut off at the same point however
+// busy the machine is.
+func BenchmarkStepBudget(b *testing.B) {
+	noErr(b, sqliteext.RegisterStepBudget())
+	const rows = 10000
+	queries := map[string]string{
+		"point": `select content from posts where id = ?`,
+		"scan":  `select sum(length(content)) from posts where id >= ?`,
+	}
+	for _, query := range []string{"point", "scan"} {
+		for _, budget := range []string{"off", "on"} {
+			b.Run(fmt.Sprintf("query=%s&budget=%s", query, budget), func(b *testing.B) {
+				options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+				db := makeDBAt(b, path.Join(b.TempDir(), "benchmark.db"), options)
+				defer db.Close()
+				db.SetMaxOpenConns(1)
+				noErr(b, insertRowsLoop(db, strings.Repeat("A", 100), rows))
+				if budget == "on" {
+					_, err := db.Exec(`select step_budget(1000000000)`)
+					noErr(b, err)
+				}
+				stmt, err := db.Prepare(queries[query])
+				noErr(b, err)
+				defer stmt.Close()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var result string
+					noErr(b, stmt.QueryRow(i%rows+1).Scan(&result))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// setupTyped creates a table with one column of each storage class and fills
+// it with n identical rows.
+func setupTyped(db *sql.DB, n int) error {
+	_, err := db.Exec(`
+		create table typed (
+			i integer,
+			r real,
+			t text,
+			bl blob,
+			n
+		)`)
+	if err != nil {
+		return err
+	}
+	return insertSeries(db, `
+		insert into typed (i, r, t, bl, n)
+		select value, value / 3.0, ?, ?, null from series`,
+		n, strings.Repeat("A", 100), []byte(strings.Repeat("B", 100)))
+}
+
+// BenchmarkScanColumnType scans a single column of each storage class into
+// its natural Go type. One op is one Next and Scan, and the query is reissued
+// every 1000 rows, so ns/op is mostly the per-value conversion cost in the
+// driver and database/sql.
+func BenchmarkScanColumnType(b *testing.B) {
+	const rows = 1000
+	columns := []struct {
+		name   string
+		column string
+		dest   any
+	}{
+		{"integer", "i", new(int64)},
+		{"real", "r", new(float64)},
+		{"text", "t", new(string)},
+		{"blob", "bl", new([]byte)},
+		{"null", "n", new(any)},
+	}
+	db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+	noErr(b, setupTyped(db, rows))
+	for _, col := range columns {
+		b.Run(fmt.Sprintf("type=%s", col.name), func(b *testing.B) {
+			query := fmt.Sprintf(`select %s from typed`, col.column)
+			benchScanRows(b, db, query, rows, func(r *sql.Rows) error {
+				return r.Scan(col.dest)
+			})
+		})
+	}
+}
+
+// benchScanRows calls scan for one row per op, reissuing query every n rows.
+func benchScanRows(b *testing.B, db *sql.DB, query string, n int, scan func(*sql.Rows) error) {
+	var r *sql.Rows
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%n == 0 {
+			if r != nil {
+				noErr(b, r.Close())
+			}
+			var err error
+			r, err = db.Query(query)
+			noErr(b, err)
+		}
+		if !r.Next() {
+			b.Fatal("ran out of rows")
+		}
+		noErr(b, scan(r))
+	}
+	b.StopTimer()
+	noErr(b, r.Close())
+}
+
+// timeFormats store a timestamp as ISO8601 TEXT, unix seconds INTEGER, or a
+// julian day REAL. The INTEGER format drops sub-second precision. go-sqlite3
+// writes time.Time values as TEXT and parses TEXT back into time.Time for
+// columns declared timestamp, datetime or date.
+var timeFormats = []struct {
+	name     string
+	decltype string
+	encode   func(time.Time) any
+	decode   func(*sql.Rows) (time.Time, error)
+}{
+	{
+		"text", "timestamp",
+		func(t time.Time) any { return t },
+		func(r *sql.Rows) (time.Time, error) {
+			var t time.Time
+			err := r.Scan(&t)
+			return t, err
+		},
+	},
+	{
+		"integer", "integer",
+		func(t time.Time) any { return t.Unix() },
+		func(r *sql.Rows) (time.Time, error) {
+			var s int64
+			err := r.Scan(&s)
+			return time.Unix(s, 0).UTC(), err
+		},
+	},
+	{
+		"real", "real",
+		func(t time.Time) any { return julianDay(t) },
+		func(r *sql.Rows) (time.Time, error) {
+			var jd float64
+			err := r.Scan(&jd)
+			return fromJulianDay(jd), err
+		},
+	},
+}
+
+// unixEpochJulianDay is the julian day number of 1970-01-01 00:00 UTC.
+const unixEpochJulianDay = 2440587.5
+
+func julianDay(t time.Time) float64 {
+	return unixEpochJulianDay + float64(t.UnixMilli())/(24*60*60*1000)
+}
+
+func fromJulianDay(jd float64) time.Time {
+	return time.UnixMilli(int64(math.Round((jd - unixEpochJulianDay) * 24 * 60 * 60 * 1000))).UTC()
+}
+
+// seedTimestamps returns n UTC timestamps with millisecond precision spread
+// randomly over 30 days, like event times would be.
+func seedTimestamps(n int) []time.Time {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts := make([]time.Time, n)
+	for i := range ts {
+		ts[i] = start.Add(time.Duration(rand.Int64N(int64(30 * 24 * time.Hour)))).Truncate(time.Millisecond)
+	}
+	return ts
+}
+
+// BenchmarkTimeFormat compares the timestamp representations. op=insert
+// inserts one timestamp per op into an indexed column, all in one
+// transaction. op=query selects a one-hour range out of 100000 timestamps and
+// scans every row into time.Time.
+func BenchmarkTimeFormat(b *testing.B) {
+	const rows = 100000
+	ts := seedTimestamps(rows)
+	for _, format := range timeFormats {
+		for _, op := range []string{"insert", "query"} {
+			b.Run(fmt.Sprintf("format=%s&op=%s", format.name, op), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				_, err := db.Exec(fmt.Sprintf(`
+					create table times (id integer primary key, ts %s not null);
+					create index times_ts on times (ts)`, format.decltype))
+				noErr(b, err)
+				insert := func(n int) {
+					tx, err := db.Begin()
+					noErr(b, err)
+					stmt, err := tx.Prepare(`insert into times (ts) values (?)`)
+					noErr(b, err)
+					for i := 0; i < n; i++ {
+						_, err := stmt.Exec(format.encode(ts[i%rows]))
+						noErr(b, err)
+					}
+					noErr(b, stmt.Close())
+					noErr(b, tx.Commit())
+				}
+				if op == "insert" {
+					b.ResetTimer()
+					insert(b.N)
+					return
+				}
+				insert(rows)
+				found := 0
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					from := ts[i%rows]
+					r, err := db.Query(`select ts from times where ts >= ? and ts < ?`,
+						format.encode(from), format.encode(from.Add(time.Hour)))
+					noErr(b, err)
+					for r.Next() {
+						t, err := format.decode(r)
+						noErr(b, err)
+						if t.Before(from.Truncate(time.Second)) {
+							b.Fatalf("got %v before %v", t, from)
+						}
+						found++
+					}
+					noErr(b, r.Err())
+					noErr(b, r.Close())
+				}
+				b.ReportMetric(float64(found)/float64(b.N), "rows/query")
+			})
+		}
+	}
+}
+
+// BenchmarkTimeAutoParse measures go-sqlite3 parsing TEXT timestamps from a
+// column declared timestamp. One op scans one row.
+//   - time: the driver parses the value into time.Time.
+//   - string: the driver still parses it, and database/sql formats the
+//     time.Time back into an RFC 3339 string.
+//   - cast: cast(ts as text) has no declared type, so the driver returns the
+//     raw string.
+//   - cast-parse: the raw string is parsed in Go with a single layout.
+//   - time-utc: like time, but with _loc=UTC the driver also converts the
+//     value to the location.
+func BenchmarkTimeAutoParse(b *testing.B) {
+	const rows = 1000
+	modes := []struct {
+		name, options, column string
+		scan                  func(*sql.Rows) error
+	}{
+		{"time", "", "ts", func(r *sql.Rows) error {
+			var t time.Time
+			return r.Scan(&t)
+		}},
+		{"string", "", "ts", func(r *sql.Rows) error {
+			var s string
+			return r.Scan(&s)
+		}},
+		{"cast", "", "cast(ts as text)", func(r *sql.Rows) error {
+			var s string
+			return r.Scan(&s)
+		}},
+		{"cast-parse", "", "cast(ts as text)", func(r *sql.Rows) error {
+			var s string
+			if err := r.Scan(&s); err != nil {
+				return err
+			}
+			_, err := time.Parse(sqlite3.SQLiteTimestampFormats[0], s)
+			return err
+		}},
+		{"time-utc", "&_loc=UTC", "ts", func(r *sql.Rows) error {
+			var t time.Time
+			return r.Scan(&t)
+		}},
+	}
+	for _, mode := range modes {
+		b.Run(fmt.Sprintf("mode=%s", mode.name), func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"+mode.options)
+			_, err := db.Exec(`create table times (id integer primary key, ts timestamp not null)`)
+			noErr(b, err)
+			for _, t := range seedTimestamps(rows) {
+				_, err := db.Exec(`insert into times (ts) values (?)`, t)
+				noErr(b, err)
+			}
+			b.ReportAllocs()
+			benchScanRows(b, db, fmt.Sprintf(`select %s from times`, mode.column), rows, mode.scan)
+		})
+	}
+}
+
+// locSettings are the _loc DSN values. Without _loc, timestamps come back
+// with the offset they were stored with (UTC for integer timestamps). With
+// _loc, the driver converts them to the location; auto is time.Local.
+var locSettings = []struct {
+	name string
+	loc  *time.Location
+}{
+	{"none", nil},
+	{"UTC", time.UTC},
+	{"Local", time.Local},
+	{"auto", time.Local},
+}
+
+// BenchmarkScanTimeLoc scans a timestamp column into time.Time under each
+// _loc setting. One op scans one row.
+func BenchmarkScanTimeLoc(b *testing.B) {
+	const rows = 1000
+	for _, setting := range locSettings {
+		b.Run(fmt.Sprintf("loc=%s", setting.name), func(b *testing.B) {
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			if setting.loc != nil {
+				options += "&_loc=" + setting.name
+			}
+			db := makeDB(b, options)
+			_, err := db.Exec(`create table times (id integer primary key, ts timestamp not null)`)
+			noErr(b, err)
+			for _, t := range seedTimestamps(rows) {
+				_, err := db.Exec(`insert into times (ts) values (?)`, t)
+				noErr(b, err)
+			}
+			b.ReportAllocs()
+			benchScanRows(b, db, `select ts from times`, rows, func(r *sql.Rows) error {
+				var t time.Time
+				return r.Scan(&t)
+			})
+		})
+	}
+}
+
+// TestScanTimeLoc checks that a timestamp stored with a non-UTC offset reads
+// back as the same instant in the location _loc selects.
+func TestScanTimeLoc(t *testing.T) {
+	stored := time.Date(2024, 1, 1, 12, 30, 0, 0, time.FixedZone("", 2*60*60))
+	for _, setting := range locSettings {
+		t.Run(fmt.Sprintf("loc=%s", setting.name), func(t *testing.T) {
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			if setting.loc != nil {
+				options += "&_loc=" + setting.name
+			}
+			db := makeDB(t, options)
+			_, err := db.Exec(`create table times (ts timestamp not null, unix timestamp not null)`)
+			noErr(t, err)
+			_, err = db.Exec(`insert into times (ts, unix) values (?, ?)`, stored, stored.Unix())
+			noErr(t, err)
+			var got, gotUnix time.Time
+			noErr(t, db.QueryRow(`select ts, unix from times`).Scan(&got, &gotUnix))
+			if !got.Equal(stored) || !gotUnix.Equal(stored) {
+				t.Fatalf("got %v and %v, want %v", got, gotUnix, stored)
+			}
+			wantLoc, wantUnixLoc := setting.loc, setting.loc
+			if wantLoc == nil {
+				wantLoc, wantUnixLoc = stored.Location(), time.UTC
+			}
+			_, offset := got.Zone()
+			_, wantOffset := stored.In(wantLoc).Zone()
+			if offset != wantOffset {
+				t.Errorf("text timestamp offset is %d, want %d", offset, wantOffset)
+			}
+			if gotUnix.Location() != wantUnixLoc {
+				t.Errorf("integer timestamp location is %v, want %v", gotUnix.Location(), wantUnixLoc)
+			}
+		})
+	}
+}
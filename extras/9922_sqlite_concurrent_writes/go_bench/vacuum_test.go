@@ -0,0 +1,276 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkReadDuringVacuum runs a full VACUUM per op while readers keep
+// reading, and reports read latency and errors during the VACUUM window.
+// In rollback journal mode VACUUM locks readers out; in WAL they keep
+// reading the last committed snapshot.
+func BenchmarkReadDuringVacuum(b *testing.B) {
+	const rows = 20000
+	for _, journal := range []string{"DELETE", "WAL"} {
+		b.Run(fmt.Sprintf("journal=%s", journal), func(b *testing.B) {
+			options := fmt.Sprintf("?_journal=%s&_timeout=5000&_fk=true&_synchronous=normal", journal)
+			db := makeDB(b, options)
+			noErr(b, insertRowsLoop(db, strings.Repeat("A", 1000), rows))
+			// Delete every other row so VACUUM has something to rewrite.
+			_, err := db.Exec(`delete from posts where id % 2 = 0`)
+			noErr(b, err)
+
+			var lats latencies
+			var readErrors atomic.Int64
+			var vacuumTime time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				done := make(chan struct{})
+				var mu sync.Mutex
+				var wg sync.WaitGroup
+				for r := 0; r < 4; r++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						var local latencies
+						for {
+							select {
+							case <-done:
+								mu.Lock()
+								lats = append(lats, local...)
+								mu.Unlock()
+								return
+							default:
+							}
+							t := time.Now()
+							_, err := readBlogPostByID(db, int64(rand.IntN(rows/2))*2+1)
+							local = append(local, time.Since(t))
+							if err != nil {
+								readErrors.Add(1)
+							}
+						}
+					}()
+				}
+				t := time.Now()
+				_, err := db.Exec(`vacuum`)
+				vacuumTime += time.Since(t)
+				close(done)
+				wg.Wait()
+				noErr(b, err)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(vacuumTime.Milliseconds())/float64(b.N), "vacuum-ms")
+			b.ReportMetric(float64(len(lats))/vacuumTime.Seconds(), "reads/s")
+			b.ReportMetric(float64(readErrors.Load()), "read-errors")
+			reportLatencies(b, lats, "read-")
+		})
+	}
+}
+
+func freelistCount(db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow(`pragma freelist_count`).Scan(&n)
+	return n, err
+}
+
+// incrementalVacuum frees up to pages pages (all if pages is 0).
+// The pragma frees one page per sqlite3_step, and db.Exec steps only once,
+// so the result rows have to be drained.
+func incrementalVacuum(db *sql.DB, pages int) error {
+	rows, err := db.Query(fmt.Sprintf(`pragma incremental_vacuum(%d)`, pages))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// BenchmarkIncrementalVacuumPacing deletes all rows of an auto_vacuum=INCREMENTAL
+// database and reclaims the free pages with incremental_vacuum(pages) in
+// chunks until the freelist is empty, while a writer keeps inserting.
+// Each chunk holds the write lock, so chunk latency is what the writer waits.
+func BenchmarkIncrementalVacuumPacing(b *testing.B) {
+	for _, pages := range []int{10, 100, 1000, 0} {
+		name := fmt.Sprint(pages)
+		if pages == 0 {
+			name = "all"
+		}
+		b.Run(fmt.Sprintf("pages=%s", name), func(b *testing.B) {
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal&_auto_vacuum=incremental"
+			db := makeDB(b, options)
+			content := strings.Repeat("A", 1000)
+			var reclaimed int
+			var reclaimTime time.Duration
+			var chunkLats, writeLats latencies
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				noErr(b, insertRowsLoop(db, content, 20000))
+				_, err := db.Exec(`delete from posts`)
+				noErr(b, err)
+				free, err := freelistCount(db)
+				noErr(b, err)
+				reclaimed += free
+				b.StartTimer()
+
+				done := make(chan struct{})
+				var wg sync.WaitGroup
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						t := time.Now()
+						err := writeBlogPost(db, "A")
+						writeLats = append(writeLats, time.Since(t))
+						if err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+				start := time.Now()
+				for free > 0 {
+					t := time.Now()
+					err := incrementalVacuum(db, pages)
+					chunkLats = append(chunkLats, time.Since(t))
+					noErr(b, err)
+					free, err = freelistCount(db)
+					noErr(b, err)
+				}
+				reclaimTime += time.Since(start)
+				close(done)
+				wg.Wait()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(reclaimed)/reclaimTime.Seconds(), "pages/s")
+			reportLatencies(b, chunkLats, "chunk-")
+			reportLatencies(b, writeLats, "write-")
+		})
+	}
+}
+
+func pageCount(db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow(`pragma page_count`).Scan(&n)
+	return n, err
+}
+
+// openAutoVacuum opens a database with _auto_vacuum=mode. If late, the
+// database is created without it first, so the DSN option is applied to a
+// database that already has tables and silently has no effect.
+func openAutoVacuum(tb testing.TB, mode string, late bool) *sql.DB {
+	dbPath := path.Join(tb.TempDir(), "benchmark.db")
+	options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+	if late {
+		makeDBAt(tb, dbPath, options).Close()
+		db, err := sql.Open("sqlite3", dbPath+options+"&_auto_vacuum="+mode)
+		noErr(tb, err)
+		return db
+	}
+	return makeDBAt(tb, dbPath, options+"&_auto_vacuum="+mode)
+}
+
+func autoVacuum(db *sql.DB) (int, error) {
+	var mode int
+	err := db.QueryRow(`pragma auto_vacuum`).Scan(&mode)
+	return mode, err
+}
+
+// TestAutoVacuumDSN checks that _auto_vacuum only takes effect when the
+// database is created with it. Changing auto_vacuum from none on an existing
+// database requires a VACUUM.
+func TestAutoVacuumDSN(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		late bool
+		want int
+	}{
+		{"none", false, 0},
+		{"full", false, 1},
+		{"incremental", false, 2},
+		{"full", true, 0},
+		{"incremental", true, 0},
+	} {
+		t.Run(fmt.Sprintf("auto_vacuum=%s&late=%t", tc.mode, tc.late), func(t *testing.T) {
+			db := openAutoVacuum(t, tc.mode, tc.late)
+			defer db.Close()
+			got, err := autoVacuum(db)
+			noErr(t, err)
+			if got != tc.want {
+				t.Errorf("auto_vacuum is %d, want %d", got, tc.want)
+			}
+			if tc.late {
+				_, err := db.Exec(`vacuum`)
+				noErr(t, err)
+				got, err := autoVacuum(db)
+				noErr(t, err)
+				if got == 0 {
+					t.Error("auto_vacuum is still none after VACUUM")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkAutoVacuumReclaim deletes all posts per op and reports how many
+// pages the file shrank by. auto_vacuum=full shrinks it on commit,
+// incremental when incremental_vacuum runs (timed here), none keeps the
+// pages on the freelist. late=true sets the same DSN option on an existing
+// database, which does nothing. auto-vacuum is the mode that took effect.
+func BenchmarkAutoVacuumReclaim(b *testing.B) {
+	for _, tc := range []struct {
+		mode string
+		late bool
+	}{
+		{"none", false},
+		{"full", false},
+		{"incremental", false},
+		{"full", true},
+	} {
+		b.Run(fmt.Sprintf("auto_vacuum=%s&late=%t", tc.mode, tc.late), func(b *testing.B) {
+			db := openAutoVacuum(b, tc.mode, tc.late)
+			defer db.Close()
+			mode, err := autoVacuum(db)
+			noErr(b, err)
+			content := strings.Repeat("A", 1000)
+			var reclaimed, free int
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				noErr(b, insertRowsLoop(db, content, 20000))
+				before, err := pageCount(db)
+				noErr(b, err)
+				b.StartTimer()
+				_, err = db.Exec(`delete from posts`)
+				noErr(b, err)
+				if mode == 2 {
+					noErr(b, incrementalVacuum(db, 0))
+				}
+				b.StopTimer()
+				after, err := pageCount(db)
+				noErr(b, err)
+				reclaimed += before - after
+				free, err = freelistCount(db)
+				noErr(b, err)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(reclaimed)/float64(b.N), "reclaimed-pages")
+			b.ReportMetric(float64(free), "free-pages")
+			b.ReportMetric(float64(mode), "auto-vacuum")
+		})
+	}
+}
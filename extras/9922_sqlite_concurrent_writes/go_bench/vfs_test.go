@@ -0,0 +1,96 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"sqlite_bench/sqliteext"
+)
+
+// BenchmarkWriteVFS compares the default unix VFS with the unix-dotfile
+// (dot-file locks instead of POSIX locks) and unix-excl (exclusive POSIX
+// locks, one process only) VFSes. Locked errors are counted, not fatal.
+// VFSes or journal modes that can't be opened are skipped.
+// Should be used with -cpu=1.
+func BenchmarkWriteVFS(b *testing.B) {
+	for _, vfs := range []string{"unix", "unix-dotfile", "unix-excl"} {
+		for _, journal := range []string{"DELETE", "WAL"} {
+			for _, concurrency := range []int{1, 4} {
+				b.Run(fmt.Sprintf("vfs=%s&journal=%s&concurrency=%d", vfs, journal, concurrency), func(b *testing.B) {
+					dbPath := path.Join(b.TempDir(), "benchmark.db")
+					options := fmt.Sprintf("?vfs=%s&_journal=%s&_timeout=5000&_fk=true&_synchronous=normal", vfs, journal)
+					db, err := sql.Open("sqlite3", dbPath+options)
+					noErr(b, err)
+					defer db.Close()
+					if err := setupDB(db); err != nil {
+						b.Skipf("vfs %s with journal %s: %v", vfs, journal, err)
+					}
+					var mode string
+					noErr(b, db.QueryRow(`pragma journal_mode`).Scan(&mode))
+					if !strings.EqualFold(mode, journal) {
+						b.Skipf("vfs %s doesn't support journal %s, got %s", vfs, journal, mode)
+					}
+					content := strings.Repeat("A", 1000)
+					var locked atomic.Int64
+					b.SetParallelism(concurrency)
+					b.ResetTimer()
+					b.RunParallel(func(pb *testing.PB) {
+						for pb.Next() {
+							err := writeBlogPost(db, content)
+							if isBusy(err) {
+								locked.Add(1)
+							} else {
+								noErr(b, err)
+							}
+						}
+					})
+					b.ReportMetric(float64(locked.Load()), "locked-errors")
+				})
+			}
+		}
+	}
+}
+
+// ioLatencies returns the injected I/O latencies to benchmark:
+// SQLITE_BENCH_IO_LATENCY_MS if set, or a sweep otherwise.
+func ioLatencies(b *testing.B) []time.Duration {
+	if ms := os.Getenv("SQLITE_BENCH_IO_LATENCY_MS"); ms != "" {
+		v, err := strconv.ParseFloat(ms, 64)
+		noErr(b, err)
+		return []time.Duration{time.Duration(v * float64(time.Millisecond))}
+	}
+	return []time.Duration{0, 100 * time.Microsecond, time.Millisecond}
+}
+
+// BenchmarkWriteLatencyVFS runs the write workload through the latency VFS,
+// which sleeps before every read, write and sync, to show how the journal
+// mode and synchronous settings behave on a slow disk.
+func BenchmarkWriteLatencyVFS(b *testing.B) {
+	noErr(b, sqliteext.RegisterLatencyVFS())
+	defer sqliteext.SetVFSLatency(0)
+	for _, latency := range ioLatencies(b) {
+		for _, journal := range []string{"DELETE", "WAL"} {
+			for _, sync := range []string{"full", "normal"} {
+				b.Run(fmt.Sprintf("latency=%s&journal=%s&synchronous=%s", latency, journal, sync), func(b *testing.B) {
+					options := fmt.Sprintf("?vfs=latency&_journal=%s&_timeout=5000&_fk=true&_synchronous=%s", journal, sync)
+					db := makeDB(b, options)
+					content := strings.Repeat("A", 1000)
+					sqliteext.SetVFSLatency(latency)
+					defer sqliteext.SetVFSLatency(0)
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						err := writeBlogPost(db, content)
+						noErr(b, err)
+					}
+				})
+			}
+		}
+	}
+}
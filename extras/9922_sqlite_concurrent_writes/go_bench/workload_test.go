@@ -0,0 +1,178 @@
+package sqlite_bench
+
+import (
+	"database/sql"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// WorkloadOp is one kind of operation in a Workload.
+type WorkloadOp struct {
+	Name   string
+	Weight int
+	Run    func() error
+}
+
+// Workload picks operations at random in proportion to their weights and
+// records the latency of each one by name.
+type Workload struct {
+	ops       []WorkloadOp
+	total     int
+	latencies map[string]latencies
+}
+
+func NewWorkload(ops ...WorkloadOp) *Workload {
+	w := &Workload{latencies: make(map[string]latencies)}
+	for _, op := range ops {
+		if op.Weight > 0 {
+			w.ops = append(w.ops, op)
+			w.total += op.Weight
+		}
+	}
+	return w
+}
+
+// Step runs one operation picked at random.
+func (w *Workload) Step() error {
+	n := rand.IntN(w.total)
+	for _, op := range w.ops {
+		if n -= op.Weight; n < 0 {
+			t := time.Now()
+			err := op.Run()
+			w.latencies[op.Name] = append(w.latencies[op.Name], time.Since(t))
+			return err
+		}
+	}
+	panic("unreachable")
+}
+
+// Report reports the count and latency percentiles of every operation.
+func (w *Workload) Report(b *testing.B) {
+	for _, op := range w.ops {
+		lats := w.latencies[op.Name]
+		if len(lats) == 0 {
+			continue
+		}
+		b.ReportMetric(float64(len(lats))/float64(b.N), op.Name+"-share")
+		reportLatencies(b, lats, op.Name+"-")
+	}
+}
+
+// oltpOps are the operations oltpWorkload runs.
+var oltpOps = []string{"read", "insert", "update", "delete"}
+
+// parseWeights parses weights like "read=70,insert=10,update=10,delete=10".
+// Every name must be one of oltpOps and every weight at least zero.
+func parseWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid weight %q", kv)
+		}
+		k = strings.TrimSpace(k)
+		if !slices.Contains(oltpOps, k) {
+			return nil, fmt.Errorf("invalid weight %q: unknown operation %q, want one of %s", kv, k, strings.Join(oltpOps, ", "))
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight %q: %w", kv, err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("invalid weight %q: negative", kv)
+		}
+		weights[k] = n
+	}
+	return weights, nil
+}
+
+func TestParseWeights(t *testing.T) {
+	weights, err := parseWeights("read=70, insert=10,update=0,delete=20")
+	noErr(t, err)
+	want := map[string]int{"read": 70, "insert": 10, "update": 0, "delete": 20}
+	if !maps.Equal(weights, want) {
+		t.Errorf("got %v, want %v", weights, want)
+	}
+	for _, s := range []string{"read=70,scan=10", "read=70,delete=-10", "read", "read=x"} {
+		if _, err := parseWeights(s); err == nil {
+			t.Errorf("parseWeights(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+// oltpWorkload returns a Workload of point reads, inserts, updates and
+// deletes on posts. The posts with ids in [lo, hi) are live: inserts append
+// at hi and deletes remove the oldest post at lo, so equal insert and delete
+// weights keep the table at its initial size.
+func oltpWorkload(db *sql.DB, weights map[string]int, lo, hi int64) *Workload {
+	content := strings.Repeat("A", 1000)
+	randomID := func() int64 { return lo + rand.Int64N(hi-lo) }
+	return NewWorkload(
+		WorkloadOp{"read", weights["read"], func() error {
+			_, err := readBlogPostByID(db, randomID())
+			return err
+		}},
+		WorkloadOp{"insert", weights["insert"], func() error {
+			if err := writeBlogPost(db, content); err != nil {
+				return err
+			}
+			hi++
+			return nil
+		}},
+		WorkloadOp{"update", weights["update"], func() error {
+			_, err := db.Exec(`update posts set content = ? where id = ?`, content, randomID())
+			return err
+		}},
+		WorkloadOp{"delete", weights["delete"], func() error {
+			if hi-lo == 1 {
+				return nil
+			}
+			if _, err := db.Exec(`delete from posts where id = ?`, lo); err != nil {
+				return err
+			}
+			lo++
+			return nil
+		}},
+	)
+}
+
+// BenchmarkOLTPMix runs a weighted mix of point reads, inserts, updates and
+// deletes against a table of 100000 posts and reports the latency of each
+// operation. Set SQLITE_BENCH_OLTP_WEIGHTS, e.g.
+// "read=70,insert=10,update=10,delete=10", to run a custom mix.
+func BenchmarkOLTPMix(b *testing.B) {
+	mixes := []struct{ name, weights string }{
+		{"read-heavy", "read=90,insert=4,update=2,delete=4"},
+		{"balanced", "read=50,insert=15,update=20,delete=15"},
+		{"write-heavy", "read=20,insert=30,update=20,delete=30"},
+	}
+	if weights := os.Getenv("SQLITE_BENCH_OLTP_WEIGHTS"); weights != "" {
+		mixes = append(mixes, struct{ name, weights string }{"custom", weights})
+	}
+	const rows = 100000
+	for _, mix := range mixes {
+		b.Run(fmt.Sprintf("mix=%s", mix.name), func(b *testing.B) {
+			weights, err := parseWeights(mix.weights)
+			noErr(b, err)
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			noErr(b, insertRowsLoop(db, strings.Repeat("A", 1000), rows))
+			w := oltpWorkload(db, weights, 1, rows+1)
+			if w.total == 0 {
+				b.Fatal("all weights are zero")
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				noErr(b, w.Step())
+			}
+			b.StopTimer()
+			w.Report(b)
+		})
+	}
+}
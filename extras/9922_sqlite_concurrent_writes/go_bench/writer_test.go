@@ -0,0 +1,595 @@
+package sqlite_bench
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeQueue serializes writes in Go: every write is sent to a single
+// goroutine that owns the only writing connection.
+type writeQueue struct {
+	db   *sql.DB
+	reqs chan writeRequest
+	wg   sync.WaitGroup
+
+	// mu guards closed and sending on reqs, so that no write is sent
+	// after reqs is closed.
+	mu     sync.RWMutex
+	closed bool
+	// abort makes run fail the writes still queued instead of running them,
+	// and enqueue fail the writes waiting for room in reqs.
+	abort     chan struct{}
+	abortOnce sync.Once
+}
+
+var errWriteQueueClosed = errors.New("write queue is closed")
+
+type writeRequest struct {
+	content string
+	done    chan error
+}
+
+func newWriteQueue(db *sql.DB, size int) *writeQueue {
+	q := &writeQueue{db: db, reqs: make(chan writeRequest, size), abort: make(chan struct{})}
+	q.wg.Add(1)
+	go q.run()
+	return q
+}
+
+func (q *writeQueue) run() {
+	defer q.wg.Done()
+	for req := range q.reqs {
+		select {
+		case <-q.abort:
+			req.done <- errWriteQueueClosed
+			continue
+		default:
+		}
+		req.done <- writeBlogPost(q.db, req.content)
+	}
+}
+
+func (q *writeQueue) write(content string) error {
+	done := make(chan error, 1)
+	if err := q.enqueue(writeRequest{content: content, done: done}); err != nil {
+		return err
+	}
+	return <-done
+}
+
+func (q *writeQueue) enqueue(req writeRequest) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return errWriteQueueClosed
+	}
+	select {
+	case q.reqs <- req:
+		return nil
+	case <-q.abort:
+		return errWriteQueueClosed
+	}
+}
+
+// stop makes new writes fail with errWriteQueueClosed. Writes already
+// waiting to be queued get in first.
+func (q *writeQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.reqs)
+	}
+}
+
+func (q *writeQueue) close() {
+	q.stop()
+	q.wg.Wait()
+}
+
+// Shutdown stops accepting writes, waits for the queued ones to be written,
+// truncates the WAL with a checkpoint and closes the database, so that the
+// next process to open it doesn't start with a WAL to replay. If ctx is done
+// before the queue is drained, the writes still queued or waiting for room
+// in a full queue fail with errWriteQueueClosed, the database is closed
+// without a checkpoint and Shutdown returns ctx.Err(). A write that is
+// running is always finished. Calling Shutdown again returns an error,
+// since the database is already closed.
+func (q *writeQueue) Shutdown(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		// stop waits for the writes waiting for room in the queue, which
+		// only fail once abort is closed.
+		q.stop()
+		q.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		q.abortOnce.Do(func() { close(q.abort) })
+		<-drained
+		return errors.Join(ctx.Err(), q.db.Close())
+	}
+	if _, err := q.db.ExecContext(ctx, `pragma wal_checkpoint(TRUNCATE)`); err != nil {
+		return errors.Join(err, q.db.Close())
+	}
+	return q.db.Close()
+}
+
+// BenchmarkWriteQueueFailFast compares relying on busy_timeout to serialize
+// concurrent writers with a Go write queue in front of a connection that
+// fails fast on a lock (_timeout=0). Locked errors are counted, not fatal.
+// Should be used with -cpu=1.
+func BenchmarkWriteQueueFailFast(b *testing.B) {
+	for _, mode := range []string{"busy-timeout", "queue"} {
+		for _, concurrency := range []int{1, 4, 16, 64, 256} {
+			b.Run(fmt.Sprintf("mode=%s&concurrency=%d", mode, concurrency), func(b *testing.B) {
+				timeout := 5000
+				if mode == "queue" {
+					timeout = 0
+				}
+				options := fmt.Sprintf("?_journal=WAL&_timeout=%d&_fk=true&_synchronous=normal", timeout)
+				db := makeDB(b, options)
+				write := func(content string) error { return writeBlogPost(db, content) }
+				if mode == "queue" {
+					q := newWriteQueue(db, concurrency)
+					defer q.close()
+					write = q.write
+				}
+				content := strings.Repeat("A", 1000)
+				var locked atomic.Int64
+				var mu sync.Mutex
+				var lats latencies
+				b.SetParallelism(concurrency)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					var local latencies
+					for pb.Next() {
+						t := time.Now()
+						err := write(content)
+						local = append(local, time.Since(t))
+						if isBusy(err) {
+							locked.Add(1)
+						} else {
+							noErr(b, err)
+						}
+					}
+					mu.Lock()
+					lats = append(lats, local...)
+					mu.Unlock()
+				})
+				b.StopTimer()
+				b.ReportMetric(float64(locked.Load()), "locked-errors")
+				reportLatencies(b, lats, "write-")
+			})
+		}
+	}
+}
+
+// TestWriteQueueShutdown queues 2000 writes and shuts the queue down with
+// enough time to drain it and with too little, while another connection
+// holds the write lock until the deadline. Every write that succeeded
+// must be in the database, and every other one, including writes after
+// Shutdown, must fail with errWriteQueueClosed. Another connection keeps
+// the database open, as another process would, so closing the queue's
+// database doesn't checkpoint and delete the WAL.
+func TestWriteQueueShutdown(t *testing.T) {
+	for _, timeout := range []time.Duration{time.Minute, time.Millisecond} {
+		t.Run(fmt.Sprintf("timeout=%s", timeout), func(t *testing.T) {
+			dbPath := path.Join(t.TempDir(), "test.db")
+			options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+			q := newWriteQueue(makeDBAt(t, dbPath, options), 2000)
+			other, err := sql.Open("sqlite3", dbPath+options)
+			noErr(t, err)
+			defer other.Close()
+			noErr(t, other.Ping())
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if timeout == time.Millisecond {
+				// Hold the write lock until the deadline, so the queue can't
+				// drain in time however fast the machine is. The write that
+				// is waiting for the lock then finishes, and Shutdown returns.
+				lock, err := other.Conn(context.Background())
+				noErr(t, err)
+				defer lock.Close()
+				_, err = lock.ExecContext(context.Background(), `begin immediate`)
+				noErr(t, err)
+				go func() {
+					<-ctx.Done()
+					if _, err := lock.ExecContext(context.Background(), `rollback`); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			dones := make([]chan error, 2000)
+			for i := range dones {
+				dones[i] = make(chan error, 1)
+				noErr(t, q.enqueue(writeRequest{content: "A", done: dones[i]}))
+			}
+
+			err = q.Shutdown(ctx)
+			if timeout == time.Minute {
+				noErr(t, err)
+			} else if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("got %v, want the queue to still be draining after %s", err, timeout)
+			}
+			if err := q.write("B"); !errors.Is(err, errWriteQueueClosed) {
+				t.Errorf("write after Shutdown: got %v, want errWriteQueueClosed", err)
+			}
+			if err := q.Shutdown(ctx); err == nil {
+				t.Error("second Shutdown succeeded, want an error")
+			}
+			var written, rejected int
+			for _, done := range dones {
+				switch err := <-done; {
+				case err == nil:
+					written++
+				case errors.Is(err, errWriteQueueClosed):
+					rejected++
+				default:
+					t.Fatal(err)
+				}
+			}
+			var count int
+			noErr(t, other.QueryRow(`select count(*) from posts`).Scan(&count))
+			if count != written {
+				t.Errorf("%d writes succeeded but %d rows are in the database", written, count)
+			}
+			if timeout == time.Minute {
+				if rejected > 0 {
+					t.Errorf("%d queued writes were rejected", rejected)
+				}
+				if size := fileSize(dbPath + "-wal"); size != 0 {
+					t.Errorf("the WAL is %d bytes after Shutdown, want it truncated", size)
+				}
+			} else if rejected == 0 {
+				t.Error("no queued write was rejected")
+			}
+		})
+	}
+}
+
+// TestWriteQueueShutdownFullQueue shuts down a full queue while a write is
+// waiting for room in it and another connection holds the write lock, so
+// the queue can't make room before the deadline.
+func TestWriteQueueShutdownFullQueue(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "test.db")
+	options := "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal"
+	q := newWriteQueue(makeDBAt(t, dbPath, options), 1)
+	other, err := sql.Open("sqlite3", dbPath+options)
+	noErr(t, err)
+	defer other.Close()
+	lock, err := other.Conn(context.Background())
+	noErr(t, err)
+	defer lock.Close()
+	_, err = lock.ExecContext(context.Background(), `begin immediate`)
+	noErr(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		if _, err := lock.ExecContext(context.Background(), `rollback`); err != nil {
+			t.Error(err)
+		}
+	}()
+	// One write is waiting for the lock, one is queued, and the last one
+	// waits for room in the queue.
+	blocked := make(chan error, 1)
+	for i := 0; i < 2; i++ {
+		noErr(t, q.enqueue(writeRequest{content: "A", done: make(chan error, 1)}))
+	}
+	go func() { blocked <- q.write("B") }()
+	// Give the last write time to start waiting.
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	if err := q.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown took %s with a 50ms deadline", elapsed)
+	}
+	if err := <-blocked; !errors.Is(err, errWriteQueueClosed) {
+		t.Errorf("write waiting for room in the queue: got %v, want errWriteQueueClosed", err)
+	}
+}
+
+// BenchmarkWriteQueueShutdown fills a write queue with backlog writes and
+// times its Shutdown, which drains them, checkpoints and closes the
+// database. The writer goroutine starts on the queue as soon as it's
+// filled, so queued is how many writes were still waiting when Shutdown
+// was called. Should be used with -cpu=1 and -benchtime=10x.
+func BenchmarkWriteQueueShutdown(b *testing.B) {
+	for _, backlog := range []int{0, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("backlog=%d", backlog), func(b *testing.B) {
+			content := strings.Repeat("A", 1000)
+			queued := 0
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				q := newWriteQueue(db, backlog)
+				for j := 0; j < backlog; j++ {
+					noErr(b, q.enqueue(writeRequest{content: content, done: make(chan error, 1)}))
+				}
+				queued += len(q.reqs)
+				b.StartTimer()
+				noErr(b, q.Shutdown(context.Background()))
+			}
+			b.ReportMetric(float64(queued)/float64(b.N), "queued")
+		})
+	}
+}
+
+// WriteBehindCache buffers writes in memory and flushes them to SQLite in
+// one transaction when full reports that the buffered rows and bytes of
+// content make a batch, or every flushInterval, whichever comes first.
+// Write returns as soon as the write is buffered and blocks only if the
+// buffer of pending writes is full. Buffered writes are lost if the process
+// crashes before the next flush.
+type WriteBehindCache struct {
+	db            *sql.DB
+	full          func(rows, bytes int) bool
+	flushInterval time.Duration
+	writes        chan string
+	done          chan struct{}
+	err           error
+
+	// commits has the duration of every flush, for the benchmarks.
+	commits latencies
+}
+
+// NewWriteBehindCache returns a WriteBehindCache that flushes when maxBatch
+// writes are buffered. Write blocks if maxBatch writes are already waiting.
+func NewWriteBehindCache(db *sql.DB, maxBatch int, flushInterval time.Duration) *WriteBehindCache {
+	return newWriteBehindCache(db, maxBatch, flushInterval, func(rows, bytes int) bool {
+		return rows >= maxBatch
+	})
+}
+
+// NewSizeBatcher returns a WriteBehindCache that sizes transactions by
+// payload bytes. It flushes when it holds maxBytes of content or maxRows
+// rows, whichever comes first. A zero limit is ignored, so maxBytes=0 gives
+// fixed row-count batching. Write blocks if 1000 writes are already waiting.
+func NewSizeBatcher(db *sql.DB, maxBytes, maxRows int, flushInterval time.Duration) *WriteBehindCache {
+	return newWriteBehindCache(db, 1000, flushInterval, func(rows, bytes int) bool {
+		return maxBytes > 0 && bytes >= maxBytes || maxRows > 0 && rows >= maxRows
+	})
+}
+
+func newWriteBehindCache(db *sql.DB, buffer int, flushInterval time.Duration, full func(rows, bytes int) bool) *WriteBehindCache {
+	c := &WriteBehindCache{
+		db:            db,
+		full:          full,
+		flushInterval: flushInterval,
+		writes:        make(chan string, buffer),
+		done:          make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *WriteBehindCache) Write(content string) {
+	c.writes <- content
+}
+
+// Close flushes the buffered writes and returns the first flush error.
+func (c *WriteBehindCache) Close() error {
+	close(c.writes)
+	<-c.done
+	return c.err
+}
+
+func (c *WriteBehindCache) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+	var batch []string
+	size := 0
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		t := time.Now()
+		if err := insertBatch(c.db, batch); err != nil && c.err == nil {
+			c.err = err
+		}
+		c.commits = append(c.commits, time.Since(t))
+		batch, size = batch[:0], 0
+	}
+	for {
+		select {
+		case content, ok := <-c.writes:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, content)
+			size += len(content)
+			if c.full(len(batch), size) {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func insertBatch(db *sql.DB, contents []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`insert into posts (content) values (?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, content := range contents {
+		if _, err := stmt.Exec(content); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// BenchmarkWriteBehindCache compares the latency of a synchronous write with
+// the latency of buffering it in a WriteBehindCache, and reports how fast
+// the cache gets the rows into SQLite, including the final flush.
+func BenchmarkWriteBehindCache(b *testing.B) {
+	for _, maxBatch := range []int{0, 10, 100, 1000} {
+		name := fmt.Sprintf("max_batch=%d", maxBatch)
+		if maxBatch == 0 {
+			name = "sync"
+		}
+		b.Run(name, func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			content := strings.Repeat("A", 1000)
+			var cache *WriteBehindCache
+			if maxBatch > 0 {
+				cache = NewWriteBehindCache(db, maxBatch, 10*time.Millisecond)
+			}
+			lats := make(latencies, 0, b.N)
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				t := time.Now()
+				if cache != nil {
+					cache.Write(content)
+				} else {
+					noErr(b, writeBlogPost(db, content))
+				}
+				lats = append(lats, time.Since(t))
+			}
+			if cache != nil {
+				noErr(b, cache.Close())
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "rows/s")
+			reportLatencies(b, lats, "write-")
+		})
+	}
+}
+
+// mixedContents returns n contents with sizes from 10 bytes to 100 KB, most
+// of them small, so that a fixed number of rows is sometimes a tiny
+// transaction and sometimes a huge one.
+func mixedContents(n int) []string {
+	sizes := []int{10, 100, 100, 100, 1000, 1000, 10000, 100000}
+	contents := make([]string, n)
+	for i := range contents {
+		contents[i] = strings.Repeat("A", sizes[rand.IntN(len(sizes))])
+	}
+	return contents
+}
+
+// BenchmarkSizeBatcher compares batching by payload bytes with batching by
+// a fixed number of rows, writing rows of mixed sizes as fast as possible.
+// It reports throughput and the distribution of commit durations.
+func BenchmarkSizeBatcher(b *testing.B) {
+	limits := []struct {
+		mode              string
+		maxBytes, maxRows int
+	}{
+		{"rows", 0, 100},
+		{"rows", 0, 1000},
+		{"bytes", 1 << 20, 0},
+		{"bytes", 4 << 20, 0},
+	}
+	contents := mixedContents(10000)
+	for _, limit := range limits {
+		b.Run(fmt.Sprintf("mode=%s&limit=%d", limit.mode, limit.maxBytes+limit.maxRows), func(b *testing.B) {
+			db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+			batcher := NewSizeBatcher(db, limit.maxBytes, limit.maxRows, 10*time.Millisecond)
+			var bytes int64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				content := contents[i%len(contents)]
+				batcher.Write(content)
+				bytes += int64(len(content))
+			}
+			noErr(b, batcher.Close())
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+			b.ReportMetric(float64(bytes)/b.Elapsed().Seconds()/(1<<20), "MB/s")
+			b.ReportMetric(float64(len(batcher.commits)), "commits")
+			reportLatencies(b, batcher.commits, "commit-")
+		})
+	}
+}
+
+// jainFairness returns Jain's fairness index of counts: 1 if all are equal,
+// 1/len(counts) if one goroutine did everything.
+func jainFairness(counts []int64) float64 {
+	var sum, sumSq float64
+	for _, c := range counts {
+		sum += float64(c)
+		sumSq += float64(c) * float64(c)
+	}
+	if sumSq == 0 {
+		return 0
+	}
+	return sum * sum / (float64(len(counts)) * sumSq)
+}
+
+// BenchmarkWriteSerialization compares three ways to have one writer at a
+// time: a Go mutex around writes (writeBlogPostMutexed), a pool of one
+// connection (SetMaxOpenConns(1)), and SQLite's own file lock with
+// busy_timeout retries. Goroutines take ops from a shared counter, so
+// fairness is how evenly the b.N writes got split between them.
+func BenchmarkWriteSerialization(b *testing.B) {
+	for _, mode := range []string{"mutex", "max-open-conns-1", "sqlite-lock"} {
+		for _, concurrency := range []int{4, 16, 64} {
+			b.Run(fmt.Sprintf("mode=%s&concurrency=%d", mode, concurrency), func(b *testing.B) {
+				db := makeDB(b, "?_journal=WAL&_timeout=5000&_fk=true&_synchronous=normal")
+				write := writeBlogPost
+				switch mode {
+				case "mutex":
+					write = writeBlogPostMutexed
+				case "max-open-conns-1":
+					db.SetMaxOpenConns(1)
+				}
+				content := strings.Repeat("A", 1000)
+				var ops atomic.Int64
+				counts := make([]int64, concurrency)
+				perWorker := make([]latencies, concurrency)
+				var wg sync.WaitGroup
+				b.ResetTimer()
+				for w := 0; w < concurrency; w++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for ops.Add(1) <= int64(b.N) {
+							t := time.Now()
+							err := write(db, content)
+							perWorker[w] = append(perWorker[w], time.Since(t))
+							if err != nil {
+								b.Error(err)
+								return
+							}
+							counts[w]++
+						}
+					}()
+				}
+				wg.Wait()
+				b.StopTimer()
+				var lats latencies
+				for _, l := range perWorker {
+					lats = append(lats, l...)
+				}
+				reportLatencies(b, lats, "write-")
+				b.ReportMetric(jainFairness(counts), "fairness")
+			})
+		}
+	}
+}